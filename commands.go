@@ -1,11 +1,47 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
+	"github.com/deltachat/deltachat-rpc-client-go/deltachat"
+
+	"maunium.net/go/mautrix/bridge"
 	"maunium.net/go/mautrix/bridge/commands"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/format"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/util"
 )
 
+// CommandProcessor is commands.Processor, but it remembers the message of each command while it's handled.
+// The arguments of commands.Event are split on whitespace, which would change passwords and passphrases.
+type CommandProcessor struct {
+	*commands.Processor
+	messages *util.SyncMap[id.EventID, string]
+}
+
+func NewCommandProcessor(br *DeltaChatBridge) *CommandProcessor {
+	return &CommandProcessor{
+		Processor: commands.NewProcessor(&br.Bridge),
+		messages:  util.NewSyncMap[id.EventID, string](),
+	}
+}
+
+func (proc *CommandProcessor) Handle(roomID id.RoomID, eventID id.EventID, user bridge.User, message string, replyTo id.EventID) {
+	proc.messages.Set(eventID, message)
+	defer proc.messages.Delete(eventID)
+
+	proc.Processor.Handle(roomID, eventID, user, message, replyTo)
+}
+
 type WrappedCommandEvent struct {
 	*commands.Event
 	Bridge *DeltaChatBridge
@@ -13,15 +49,81 @@ type WrappedCommandEvent struct {
 	Portal *Portal
 }
 
-var HelpSectionPortalManagement = commands.HelpSection{Name: "Portal management", Order: 20}
+// Reply sends a reply to the command like commands.Event.Reply, but encrypts it if the room is encrypted.
+func (ce *WrappedCommandEvent) Reply(msg string, args ...interface{}) {
+	msg = strings.ReplaceAll(msg, "$cmdprefix ", ce.Bridge.Config.Bridge.GetCommandPrefix()+" ")
+	if len(args) > 0 {
+		msg = fmt.Sprintf(msg, args...)
+	}
+	ce.ReplyAdvanced(msg, true, false)
+}
+
+// ReplyAdvanced sends a reply to the command like commands.Event.ReplyAdvanced, but encrypts it if the room
+// is encrypted.
+func (ce *WrappedCommandEvent) ReplyAdvanced(msg string, allowMarkdown, allowHTML bool) {
+	content := format.RenderMarkdown(msg, allowMarkdown, allowHTML)
+	content.MsgType = event.MsgNotice
+	_, err := ce.Bridge.SendMessageEvent(ce.MainIntent(), ce.RoomID, event.EventMessage, &event.Content{Parsed: &content})
+	if err != nil {
+		ce.ZLog.Error().Err(err).Msg("Failed to reply to command")
+	}
+}
+
+// rawArgs returns the arguments of the command exactly as they were sent. Messages sent in reply to a command
+// state have no command name, so all of the message is returned for them.
+func (ce *WrappedCommandEvent) rawArgs() string {
+	message, ok := ce.Bridge.CommandProcessor.(*CommandProcessor).messages.Get(ce.EventID)
+	if !ok {
+		return strings.Join(ce.Args, " ")
+	} else if ce.Command == "" {
+		return message
+	}
+
+	_, args := cutArg(message)
+	return args
+}
+
+// cutArg splits the first whitespace-separated argument off s. Only a single whitespace character after
+// the argument is removed, so the rest is kept as it was sent.
+func cutArg(s string) (string, string) {
+	s = strings.TrimLeftFunc(s, unicode.IsSpace)
+	end := strings.IndexFunc(s, unicode.IsSpace)
+	if end < 0 {
+		return s, ""
+	}
+
+	_, size := utf8.DecodeRuneInString(s[end:])
+	return s[:end], s[end+size:]
+}
+
+var (
+	HelpSectionPortalManagement = commands.HelpSection{Name: "Portal management", Order: 20}
+	HelpSectionEncryption       = commands.HelpSection{Name: "Encryption", Order: 25}
+)
 
 func (br *DeltaChatBridge) RegisterCommands() {
-	proc := br.CommandProcessor.(*commands.Processor)
+	proc := br.CommandProcessor.(*CommandProcessor)
 	proc.AddHandlers(
 		cmdSet,
 		cmdGet,
+		cmdConfig,
+		cmdSetAvatar,
 		cmdLogin,
+		cmdLoginQR,
 		cmdLogout,
+		cmdImportBackup,
+		cmdExportBackup,
+		cmdPairDevice,
+		cmdReceiveBackup,
+		cmdFingerprint,
+		cmdExportKey,
+		cmdImportKey,
+		cmdSendAutocryptSetup,
+		cmdAcceptAutocryptSetup,
+		cmdEncryptionInfo,
+		cmdInviteQR,
+		cmdJoin,
+		cmdBroadcastRecipients,
 		cmdConnect,
 		cmdDisconnect,
 		cmdPing,
@@ -45,7 +147,7 @@ var cmdLogin = &commands.FullHandler{
 	Name: "login",
 	Help: commands.HelpMeta{
 		Section:     commands.HelpSectionAuth,
-		Description: "Login to your configured email account",
+		Description: "Login to your email account",
 	},
 }
 
@@ -55,12 +157,251 @@ func fnLogin(ce *WrappedCommandEvent) {
 		return
 	}
 
+	ce.User.SetCommandState(&commands.CommandState{
+		Next:   commands.MinimalHandlerFunc(wrapCommand(fnLoginAddress)),
+		Action: "Login",
+	})
+	ce.Reply("Please send your email address, or `$cmdprefix cancel` to cancel.")
+}
+
+func fnLoginAddress(ce *WrappedCommandEvent) {
+	addr := ce.Args[0]
+	if len(ce.Args) != 1 || !strings.Contains(addr, "@") {
+		ce.Reply("That doesn't look like an email address. Please try again, or send `$cmdprefix cancel` to cancel.")
+		return
+	}
+
+	err := ce.User.SetConfig("addr", addr)
+	if err != nil {
+		ce.User.SetCommandState(nil)
+		ce.Reply("Error: %s", humanizeError(err))
+		return
+	}
+
+	info, err := ce.User.GetProviderInfo(addr)
+	if err != nil {
+		ce.ZLog.Warn().Err(err).Msg("Failed to get provider info")
+	} else if info != nil && info.Status == ProviderStatusBroken {
+		ce.User.SetCommandState(nil)
+		ce.Reply("Your email provider doesn't work with Delta Chat: %s\n\nSee %s for more information.", info.BeforeLoginHint, info.OverviewPage)
+		return
+	} else if info != nil && info.Status == ProviderStatusPreparation {
+		ce.Reply("Your email provider requires some preparation: %s\n\nSee %s for more information.", info.BeforeLoginHint, info.OverviewPage)
+	}
+
+	ce.User.SetCommandState(&commands.CommandState{
+		Next:   commands.MinimalHandlerFunc(wrapCommand(fnLoginPassword)),
+		Action: "Login",
+	})
+	ce.Reply("Please send your password. The message will be redacted after reading it.")
+}
+
+func fnLoginPassword(ce *WrappedCommandEvent) {
+	defer ce.Redact()
+
+	err := ce.User.SetConfig("mail_pw", ce.rawArgs())
+	if err != nil {
+		ce.User.SetCommandState(nil)
+		ce.Reply("Error: %s", humanizeError(err))
+		return
+	}
+
+	ce.User.SetCommandState(nil)
+	loginAndConnect(ce)
+}
+
+func loginAndConnect(ce *WrappedCommandEvent) {
 	err := ce.User.Login()
 	if err != nil {
-		ce.Reply("Error: %v", err)
-	} else {
-		ce.Reply("Login initiated, will post status here!")
+		ce.User.SetCommandState(&commands.CommandState{
+			Next:   commands.MinimalHandlerFunc(wrapCommand(fnLoginFailed)),
+			Action: "Login",
+		})
+		ce.Reply("Failed to log in: %s\n\n"+
+			"Send `advanced` to enter the IMAP and SMTP server settings manually, `retry` to try again, "+
+			"or `$cmdprefix cancel` to cancel.", humanizeError(err))
+		return
+	}
+
+	err = ce.User.Connect()
+	if err != nil {
+		ce.Reply("Logged in, but failed to connect: %s", humanizeError(err))
+		return
+	}
+
+	addr, _ := ce.User.GetConfig("configured_addr")
+	ce.Reply("Successfully logged in as %s", addr)
+}
+
+func fnLoginFailed(ce *WrappedCommandEvent) {
+	switch strings.ToLower(ce.Args[0]) {
+	case "advanced":
+		step := nextAdvancedLoginStep(ce.User, 0)
+		if step >= len(advancedLoginSettings) {
+			ce.Reply("You're not allowed to change the server settings. Send `retry` to try again, " +
+				"or `$cmdprefix cancel` to cancel.")
+			return
+		}
+
+		ce.User.SetCommandState(&commands.CommandState{
+			Next:   commands.MinimalHandlerFunc(wrapCommand(fnLoginAdvanced)),
+			Action: "Login",
+			Meta:   step,
+		})
+		setting, _ := getSetting(advancedLoginSettings[step])
+		ce.Reply(loginSettingPrompt(setting))
+	case "retry":
+		ce.User.SetCommandState(nil)
+		loginAndConnect(ce)
+	default:
+		ce.Reply("Send `advanced` to enter the IMAP and SMTP server settings manually, `retry` to try again, " +
+			"or `$cmdprefix cancel` to cancel.")
+	}
+}
+
+func loginSettingPrompt(setting Setting) string {
+	return fmt.Sprintf("Please send the %s, or `-` to detect it automatically.", setting.Description)
+}
+
+// advancedLoginSettings are the settings asked for in the advanced login flow, in order.
+var advancedLoginSettings = []string{
+	"mail_server",
+	"mail_port",
+	"mail_security",
+	"mail_user",
+	"send_server",
+	"send_port",
+	"send_security",
+	"send_user",
+}
+
+// nextAdvancedLoginStep returns the first step from the given one that asks for a setting the user may change.
+func nextAdvancedLoginStep(user *User, step int) int {
+	for ; step < len(advancedLoginSettings); step++ {
+		if setting, _ := getSetting(advancedLoginSettings[step]); setting.CanChange(user) {
+			break
+		}
+	}
+	return step
+}
+
+func fnLoginAdvanced(ce *WrappedCommandEvent) {
+	state := ce.User.GetCommandState()
+	step := state.Meta.(int)
+	setting, _ := getSetting(advancedLoginSettings[step])
+
+	value := ce.rawArgs()
+	if strings.TrimSpace(value) == "-" {
+		value = ""
+	}
+
+	value, err := setting.Parse(ce.User, value)
+	if err == ErrSettingNotAllowed {
+		ce.User.SetCommandState(nil)
+		ce.Reply("You're not allowed to change `%s`", setting.Key)
+		return
+	} else if err != nil {
+		ce.Reply("%v. %s", err, loginSettingPrompt(setting))
+		return
+	}
+
+	err = ce.User.SetConfig(setting.Key, value)
+	if err != nil {
+		ce.User.SetCommandState(nil)
+		ce.Reply("Error: %s", humanizeError(err))
+		return
+	}
+
+	step = nextAdvancedLoginStep(ce.User, step+1)
+	if step >= len(advancedLoginSettings) {
+		ce.User.SetCommandState(nil)
+		loginAndConnect(ce)
+		return
+	}
+
+	ce.User.SetCommandState(&commands.CommandState{
+		Next:   state.Next,
+		Action: state.Action,
+		Meta:   step,
+	})
+	setting, _ = getSetting(advancedLoginSettings[step])
+	ce.Reply(loginSettingPrompt(setting))
+}
+
+var cmdLoginQR = &commands.FullHandler{
+	Func: wrapCommand(fnLoginQR),
+	Name: "login-qr",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionAuth,
+		Description: "Login with a DCACCOUNT or DCLOGIN code. Without a code, you can upload an image of the QR code instead.",
+		Args:        "[_code_]",
+	},
+}
+
+func fnLoginQR(ce *WrappedCommandEvent) {
+	if len(ce.Args) > 1 {
+		ce.Reply("**Usage**: `$cmdprefix login-qr [code]`")
+		return
+	} else if len(ce.Args) == 1 {
+		// DCLOGIN codes contain the password
+		defer ce.Redact()
+	}
+
+	if ce.User.IsLoggedIn() {
+		ce.Reply("You're already logged in")
+		return
+	}
+
+	if len(ce.Args) == 0 {
+		ce.User.SetCommandState(&commands.CommandState{
+			Next:   commands.MinimalHandlerFunc(wrapCommand(fnAwaitingUpload)),
+			Action: "Login",
+			Meta:   FileUploadHandler(loginWithQRImage),
+		})
+		ce.Reply("Please upload an image of the QR code, or send `$cmdprefix cancel` to cancel.")
+		return
+	}
+
+	err := ce.User.LoginWithQR(ce.Args[0])
+	if err != nil {
+		ce.Reply("Failed to log in: %v", err)
+		return
+	}
+
+	addr, _ := ce.User.GetConfig("configured_addr")
+	ce.Reply("Successfully logged in as %s", addr)
+}
+
+func loginWithQRImage(user *User, evt *event.Event, content *event.MessageEventContent) {
+	if content.MsgType != event.MsgImage {
+		user.sendNotice("That's not an image. Send `%s login-qr` to try again.", user.bridge.Config.Bridge.GetCommandPrefix())
+		return
+	}
+
+	data, err := user.bridge.DownloadMatrixFile(content)
+	if err != nil {
+		user.log.Err(err).Msg("Failed to download QR code image")
+		user.sendNotice("Failed to download image: %v", err)
+		return
+	}
+
+	qr, err := decodeQRImage(data)
+	if err != nil {
+		user.sendNotice("Failed to read QR code: %v", err)
+		return
+	}
+
+	// DCLOGIN codes contain the password
+	_, _ = user.bridge.Bot.RedactEvent(evt.RoomID, evt.ID)
+
+	err = user.LoginWithQR(qr)
+	if err != nil {
+		user.sendNotice("Failed to log in: %v", err)
+		return
 	}
+
+	addr, _ := user.GetConfig("configured_addr")
+	user.sendNotice("Successfully logged in as %s", addr)
 }
 
 var cmdLogout = &commands.FullHandler{
@@ -73,8 +414,639 @@ var cmdLogout = &commands.FullHandler{
 }
 
 func fnLogout(ce *WrappedCommandEvent) {
-	ce.User.Logout(false)
-	ce.Reply("Logged out successfully.")
+	err := ce.User.Logout()
+	if err == ErrNotLoggedIn {
+		ce.Reply("You're not logged in")
+	} else if err != nil {
+		ce.Reply("Error: %v", err)
+	} else {
+		ce.Reply("Logged out successfully.")
+	}
+}
+
+var cmdImportBackup = &commands.FullHandler{
+	Func: wrapCommand(fnImportBackup),
+	Name: "import-backup",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionAuth,
+		Description: "Import a Delta Chat backup file and log in with it. Passphrases only work in encrypted rooms.",
+		Args:        "[_passphrase_]",
+	},
+}
+
+func fnImportBackup(ce *WrappedCommandEvent) {
+	if ce.User.IsLoggedIn() {
+		ce.Reply("You're already logged in. Log out first to import a backup.")
+		return
+	}
+
+	passphrase := ce.rawArgs()
+	if passphrase != "" {
+		defer ce.Redact()
+
+		if !ce.canSendSecrets() {
+			ce.Reply("Passphrases can only be sent in encrypted rooms.")
+			return
+		}
+	}
+
+	ce.User.SetCommandState(&commands.CommandState{
+		Next:   commands.MinimalHandlerFunc(wrapCommand(fnAwaitingUpload)),
+		Action: "Backup import",
+		Meta: FileUploadHandler(func(user *User, evt *event.Event, content *event.MessageEventContent) {
+			importBackup(user, content, passphrase)
+		}),
+	})
+	ce.Reply("Please upload the backup `.tar` file, or send `$cmdprefix cancel` to cancel.")
+}
+
+func fnAwaitingUpload(ce *WrappedCommandEvent) {
+	ce.Reply("Please upload the file, or send `$cmdprefix cancel` to cancel.")
+}
+
+func importBackup(user *User, content *event.MessageEventContent, passphrase string) {
+	fileName := content.FileName
+	if fileName == "" {
+		fileName = content.Body
+	}
+	if !strings.HasSuffix(strings.ToLower(fileName), ".tar") {
+		user.sendNotice("That doesn't look like a Delta Chat backup. Backups are `.tar` files.")
+		return
+	}
+
+	path, err := user.bridge.DownloadMatrixFileToTemp(content, "mautrix-deltachat-backup-*.tar")
+	if err != nil {
+		user.log.Err(err).Msg("Failed to download backup")
+		user.sendNotice("Failed to download backup: %v", err)
+		return
+	}
+	defer os.Remove(path)
+
+	err = user.ImportBackup(path, passphrase)
+	if err != nil {
+		user.sendNotice("Failed to import backup: %s", humanizeError(err))
+		return
+	}
+
+	addr, _ := user.GetConfig("configured_addr")
+	user.sendNotice("Successfully imported backup and logged in as %s", addr)
+}
+
+var cmdExportBackup = &commands.FullHandler{
+	Func: wrapCommand(fnExportBackup),
+	Name: "export-backup",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionAuth,
+		Description: "Export a passphrase-protected backup of your Delta Chat account. A random passphrase is generated if none is given. Only works in encrypted rooms.",
+		Args:        "[_passphrase_]",
+	},
+	RequiresLogin: true,
+}
+
+func fnExportBackup(ce *WrappedCommandEvent) {
+	passphrase := ce.rawArgs()
+	generated := passphrase == ""
+	if generated {
+		passphrase = util.RandomString(32)
+	} else {
+		defer ce.Redact()
+	}
+
+	// The backup contains the secret keys, so it must not be readable by the homeserver
+	if !ce.canSendSecrets() {
+		ce.Reply("Backups can only be exported to encrypted rooms.")
+		return
+	}
+
+	dir, err := os.MkdirTemp("", "mautrix-deltachat-backup-")
+	if err != nil {
+		ce.Reply("Failed to create temporary directory: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	path, err := ce.User.ExportBackup(dir, passphrase)
+	if err != nil {
+		ce.Reply("Failed to export backup: %s", humanizeError(err))
+		return
+	}
+
+	fileName := filepath.Base(path)
+	content := &event.MessageEventContent{
+		MsgType:  event.MsgFile,
+		Body:     fileName,
+		FileName: fileName,
+	}
+
+	err = ce.Bridge.UploadMatrixFile(ce.Bot, ce.RoomID, path, fileName, "application/x-tar", content)
+	if err != nil {
+		ce.Reply("Failed to upload backup: %v", err)
+		return
+	}
+
+	_, err = ce.Bridge.SendMessageEvent(ce.Bot, ce.RoomID, event.EventMessage, &event.Content{Parsed: content})
+	if err != nil {
+		ce.Reply("Failed to send backup: %v", err)
+		return
+	}
+
+	if generated {
+		ce.Reply("The backup is protected with the passphrase `%s`", passphrase)
+	}
+}
+
+// canSendSecrets returns whether files with secret keys may be sent to the room, which requires end-to-end
+// encryption.
+func (ce *WrappedCommandEvent) canSendSecrets() bool {
+	return ce.Bridge.Crypto != nil && ce.Bridge.IsRoomEncrypted(ce.RoomID)
+}
+
+var cmdPairDevice = &commands.FullHandler{
+	Func: wrapCommand(fnPairDevice),
+	Name: "pair-device",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionAuth,
+		Description: "Show a QR code to add another Delta Chat device to your account. Only works in encrypted rooms.",
+	},
+	RequiresLogin: true,
+}
+
+// How long pair-device waits for the other device to receive the backup
+const accountTransferTimeout = 10 * time.Minute
+
+func fnPairDevice(ce *WrappedCommandEvent) {
+	// The QR code gives whoever scans it the whole account, so it must not be readable by the homeserver
+	if !ce.canSendSecrets() {
+		ce.Reply("Account transfer QR codes can only be sent to encrypted rooms.")
+		return
+	}
+
+	ce.Reply("Preparing account transfer, this may take a moment...")
+
+	ctx, cancel := context.WithTimeout(context.Background(), accountTransferTimeout)
+	defer cancel()
+
+	qr, done, err := ce.User.ProvideBackup(ctx)
+	if err != nil {
+		ce.Reply("Failed to prepare account transfer: %s", humanizeError(err))
+		return
+	}
+
+	if err = sendQRImage(ce, qr); err != nil {
+		cancel()
+		<-done
+		ce.Reply("Failed to send QR code: %v", err)
+		return
+	}
+
+	// The builtin cancel command clears the state, which cancels the context
+	state := &commands.CommandState{
+		Next:   commands.MinimalHandlerFunc(wrapCommand(fnAwaitingTransfer)),
+		Action: "Account transfer",
+		Meta:   context.CancelFunc(cancel),
+	}
+	ce.User.SetCommandState(state)
+	ce.Reply("Scan the QR code with Delta Chat on your other device (\"Add as Second Device\" on the welcome screen), " +
+		"or send `$cmdprefix cancel` to cancel.")
+
+	err = <-done
+	ctxErr := ctx.Err()
+	if ce.User.GetCommandState() == state {
+		ce.User.SetCommandState(nil)
+	}
+
+	switch {
+	case ctxErr == context.DeadlineExceeded:
+		ce.Reply("Account transfer timed out, as no device received the backup within %d minutes.", int(accountTransferTimeout.Minutes()))
+	case ctxErr == context.Canceled:
+		// The cancel command already replied
+	case err != nil:
+		ce.Reply("Account transfer failed: %s", humanizeError(err))
+	default:
+		ce.Reply("Account transferred successfully.")
+	}
+}
+
+func fnAwaitingTransfer(ce *WrappedCommandEvent) {
+	ce.Reply("Waiting for your other device to receive the backup. Send `$cmdprefix cancel` to cancel.")
+}
+
+var cmdReceiveBackup = &commands.FullHandler{
+	Func: wrapCommand(fnReceiveBackup),
+	Name: "receive-backup",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionAuth,
+		Description: "Set up the bridge as a second device of an existing Delta Chat installation. Only works in encrypted rooms.",
+		Args:        "<_DCBACKUP code_>",
+	},
+}
+
+func fnReceiveBackup(ce *WrappedCommandEvent) {
+	if len(ce.Args) != 1 {
+		ce.Reply("**Usage**: `$cmdprefix receive-backup <DCBACKUP code>`")
+		return
+	}
+
+	// The code contains the ticket for the transfer
+	defer ce.Redact()
+
+	if !ce.canSendSecrets() {
+		ce.Reply("Account transfer codes can only be sent in encrypted rooms.")
+		return
+	}
+
+	if ce.User.IsLoggedIn() {
+		ce.Reply("You're already logged in. Log out first to receive a backup.")
+		return
+	}
+
+	err := ce.User.ReceiveBackup(ce.Args[0])
+	if err != nil {
+		ce.Reply("Failed to receive backup: %s", humanizeError(err))
+		return
+	}
+
+	addr, _ := ce.User.GetConfig("configured_addr")
+	ce.Reply("Successfully received backup and logged in as %s", addr)
+}
+
+var cmdFingerprint = &commands.FullHandler{
+	Func: wrapCommand(fnFingerprint),
+	Name: "fingerprint",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionEncryption,
+		Description: "Show the fingerprint of your OpenPGP key.",
+	},
+	RequiresLogin: true,
+}
+
+func fnFingerprint(ce *WrappedCommandEvent) {
+	fingerprint, err := ce.User.Fingerprint()
+	if err != nil {
+		ce.Reply("Failed to get fingerprint: %s", humanizeError(err))
+		return
+	}
+
+	ce.Reply("Your key fingerprint is `%s`", fingerprint)
+}
+
+var cmdExportKey = &commands.FullHandler{
+	Func: wrapCommand(fnExportKey),
+	Name: "export-key",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionEncryption,
+		Description: "Export your OpenPGP secret key. Only works in encrypted rooms.",
+	},
+	RequiresLogin: true,
+}
+
+func fnExportKey(ce *WrappedCommandEvent) {
+	// The key is exported without a passphrase, so it must not be readable by the homeserver
+	if !ce.canSendSecrets() {
+		ce.Reply("Keys can only be exported to encrypted rooms.")
+		return
+	}
+
+	dir, err := os.MkdirTemp("", "mautrix-deltachat-keys-")
+	if err != nil {
+		ce.Reply("Failed to create temporary directory: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	path, err := ce.User.ExportSecretKey(dir)
+	if err != nil {
+		ce.Reply("Failed to export key: %s", humanizeError(err))
+		return
+	}
+
+	fileName := filepath.Base(path)
+	content := &event.MessageEventContent{
+		MsgType:  event.MsgFile,
+		Body:     fileName,
+		FileName: fileName,
+	}
+
+	err = ce.Bridge.UploadMatrixFile(ce.Bot, ce.RoomID, path, fileName, "application/pgp-keys", content)
+	if err != nil {
+		ce.Reply("Failed to upload key: %v", err)
+		return
+	}
+
+	_, err = ce.Bridge.SendMessageEvent(ce.Bot, ce.RoomID, event.EventMessage, &event.Content{Parsed: content})
+	if err != nil {
+		ce.Reply("Failed to send key: %v", err)
+		return
+	}
+
+	ce.Reply("This file contains your unencrypted secret key. Keep it safe and redact it once you've saved it.")
+}
+
+var cmdImportKey = &commands.FullHandler{
+	Func: wrapCommand(fnImportKey),
+	Name: "import-key",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionEncryption,
+		Description: "Import an OpenPGP secret key and use it as your default key.",
+	},
+	RequiresLogin: true,
+}
+
+func fnImportKey(ce *WrappedCommandEvent) {
+	ce.User.SetCommandState(&commands.CommandState{
+		Next:   commands.MinimalHandlerFunc(wrapCommand(fnAwaitingUpload)),
+		Action: "Key import",
+		Meta:   FileUploadHandler(importKey),
+	})
+	ce.Reply("Please upload the ASCII-armored secret key (`.asc` file), or send `$cmdprefix cancel` to cancel.")
+}
+
+func importKey(user *User, evt *event.Event, content *event.MessageEventContent) {
+	// The key is not protected by a passphrase
+	_, _ = user.bridge.Bot.RedactEvent(evt.RoomID, evt.ID)
+
+	dir, err := os.MkdirTemp("", "mautrix-deltachat-keys-")
+	if err != nil {
+		user.sendNotice("Failed to create temporary directory: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	data, err := user.bridge.DownloadMatrixFile(content)
+	if err != nil {
+		user.log.Err(err).Msg("Failed to download key")
+		user.sendNotice("Failed to download key: %v", err)
+		return
+	}
+
+	// The core only imports files with an .asc extension
+	err = os.WriteFile(filepath.Join(dir, "private-key-import.asc"), data, 0600)
+	if err != nil {
+		user.sendNotice("Failed to save key: %v", err)
+		return
+	}
+
+	err = user.ImportSecretKeys(dir)
+	if err != nil {
+		user.sendNotice("Failed to import key: %s", humanizeError(err))
+		return
+	}
+
+	fingerprint, err := user.Fingerprint()
+	if err != nil {
+		user.sendNotice("Key imported, but failed to get fingerprint: %s", humanizeError(err))
+		return
+	}
+
+	user.sendNotice("Key imported. Your key fingerprint is now `%s`", fingerprint)
+}
+
+var cmdSendAutocryptSetup = &commands.FullHandler{
+	Func: wrapCommand(fnSendAutocryptSetup),
+	Name: "send-autocrypt-setup",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionEncryption,
+		Description: "Send an Autocrypt Setup Message to transfer your secret key to another email client. Only works in encrypted rooms.",
+	},
+	RequiresLogin: true,
+}
+
+func fnSendAutocryptSetup(ce *WrappedCommandEvent) {
+	// The setup code decrypts the secret key in the message, so it must not be readable by the homeserver
+	if !ce.canSendSecrets() {
+		ce.Reply("Autocrypt setup codes can only be sent to encrypted rooms.")
+		return
+	}
+
+	setupCode, err := ce.User.SendAutocryptSetupMessage()
+	if err != nil {
+		ce.Reply("Failed to send Autocrypt Setup Message: %s", humanizeError(err))
+		return
+	}
+
+	ce.Reply("An Autocrypt Setup Message was sent to yourself. Open it in your other email client and enter the setup code `%s`", setupCode)
+}
+
+var cmdAcceptAutocryptSetup = &commands.FullHandler{
+	Func: wrapCommand(fnAcceptAutocryptSetup),
+	Name: "accept-autocrypt-setup",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionEncryption,
+		Description: "Import the secret key from an Autocrypt Setup Message sent by another email client.",
+		Args:        "<_message ID_> <_setup code_>",
+	},
+	RequiresLogin: true,
+}
+
+func fnAcceptAutocryptSetup(ce *WrappedCommandEvent) {
+	if len(ce.Args) < 2 {
+		ce.Reply("**Usage**: `$cmdprefix accept-autocrypt-setup <message ID> <setup code>`")
+		return
+	}
+
+	// The setup code decrypts the secret key
+	defer ce.Redact()
+
+	msgID, err := strconv.ParseUint(ce.Args[0], 10, 32)
+	if err != nil {
+		ce.Reply("Invalid message ID")
+		return
+	}
+
+	// The core ignores everything but the digits of the setup code
+	setupCode := strings.Join(ce.Args[1:], "")
+
+	err = ce.User.AcceptAutocryptSetupMessage(deltachat.MsgId(msgID), setupCode)
+	if err != nil {
+		ce.Reply("Failed to accept Autocrypt Setup Message: %s", humanizeError(err))
+		return
+	}
+
+	fingerprint, err := ce.User.Fingerprint()
+	if err != nil {
+		ce.Reply("Key imported, but failed to get fingerprint: %s", humanizeError(err))
+		return
+	}
+
+	ce.Reply("Key imported. Your key fingerprint is now `%s`", fingerprint)
+}
+
+var cmdEncryptionInfo = &commands.FullHandler{
+	Func: wrapCommand(fnEncryptionInfo),
+	Name: "encryption-info",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionEncryption,
+		Description: "Show the fingerprint and encryption status of a contact.",
+		Args:        "<_address_>",
+	},
+	RequiresLogin: true,
+}
+
+func fnEncryptionInfo(ce *WrappedCommandEvent) {
+	if len(ce.Args) != 1 {
+		ce.Reply("**Usage**: `$cmdprefix encryption-info <address>`")
+		return
+	}
+
+	info, verified, err := ce.User.ContactEncryptionInfo(ce.Args[0])
+	if err != nil {
+		ce.Reply("Failed to get encryption info: %s", humanizeError(err))
+		return
+	}
+
+	status := "not verified"
+	if verified {
+		status = "verified"
+	}
+
+	ce.Reply("%s is %s.\n\n```\n%s\n```", ce.Args[0], status, info)
+}
+
+func sendQRImage(ce *WrappedCommandEvent, text string) error {
+	data, err := encodeQRImage(text)
+	if err != nil {
+		return err
+	}
+
+	content := &event.MessageEventContent{
+		MsgType: event.MsgImage,
+		Body:    "qr.png",
+		Info: &event.FileInfo{
+			Width:  qrImageSize,
+			Height: qrImageSize,
+		},
+	}
+
+	err = ce.Bridge.UploadMatrixMedia(ce.Bot, ce.RoomID, data, content.Body, "image/png", content)
+	if err != nil {
+		return err
+	}
+
+	_, err = ce.Bridge.SendMessageEvent(ce.Bot, ce.RoomID, event.EventMessage, &event.Content{Parsed: content})
+	return err
+}
+
+var cmdInviteQR = &commands.FullHandler{
+	Func: wrapCommand(fnInviteQR),
+	Name: "invite-qr",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionEncryption,
+		Description: "Show a QR code for others to verify you, or to join the group when used in a group portal.",
+	},
+	RequiresLogin: true,
+}
+
+func fnInviteQR(ce *WrappedCommandEvent) {
+	var chatID *deltachat.ChatId
+	if ce.Portal != nil {
+		if ce.Portal.Type != deltachat.CHAT_TYPE_GROUP {
+			ce.Reply("Invite codes can only be created for groups")
+			return
+		}
+		chatID = &ce.Portal.ChatID
+	}
+
+	qr, err := ce.User.InviteQR(chatID)
+	if err != nil {
+		ce.Reply("Failed to get invite code: %s", humanizeError(err))
+		return
+	}
+
+	if err = sendQRImage(ce, qr); err != nil {
+		ce.Reply("Failed to send QR code: %v", err)
+		return
+	}
+
+	ce.Reply("Scan the QR code with Delta Chat, or use the code `%s`", qr)
+}
+
+var cmdJoin = &commands.FullHandler{
+	Func: wrapCommand(fnJoin),
+	Name: "join",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionEncryption,
+		Description: "Verify a contact or join a verified group with an invite code.",
+		Args:        "<_code_>",
+	},
+	RequiresLogin: true,
+}
+
+func fnJoin(ce *WrappedCommandEvent) {
+	if len(ce.Args) != 1 {
+		ce.Reply("**Usage**: `$cmdprefix join <code>`")
+		return
+	}
+
+	_, err := ce.User.SecureJoin(ce.Args[0])
+	if err != nil {
+		ce.Reply("Failed to join: %s", humanizeError(err))
+		return
+	}
+
+	ce.Reply("Started verification, the chat will appear once it's complete.")
+}
+
+var cmdBroadcastRecipients = &commands.FullHandler{
+	Func: wrapCommand(fnBroadcastRecipients),
+	Name: "broadcast-recipients",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionPortalManagement,
+		Description: "List the recipients of a broadcast list, or add or remove one.",
+		Args:        "[add|remove <_address_>]",
+	},
+	RequiresLogin:  true,
+	RequiresPortal: true,
+}
+
+func fnBroadcastRecipients(ce *WrappedCommandEvent) {
+	if ce.Portal.Type != deltachat.CHAT_TYPE_BROADCAST {
+		ce.Reply("This is not a broadcast list")
+		return
+	}
+
+	if len(ce.Args) == 0 {
+		recipients, err := ce.Portal.BroadcastRecipients()
+		if err != nil {
+			ce.Reply("Failed to get recipients: %s", humanizeError(err))
+			return
+		} else if len(recipients) == 0 {
+			ce.Reply("The broadcast list has no recipients")
+			return
+		}
+
+		var sb strings.Builder
+		sb.WriteString("Recipients:\n\n")
+		for _, recipient := range recipients {
+			if recipient.DisplayName != "" && recipient.DisplayName != recipient.Address {
+				sb.WriteString(fmt.Sprintf("* %s (%s)\n", recipient.DisplayName, recipient.Address))
+			} else {
+				sb.WriteString(fmt.Sprintf("* %s\n", recipient.Address))
+			}
+		}
+		ce.Reply(sb.String())
+		return
+	} else if len(ce.Args) != 2 || (ce.Args[0] != "add" && ce.Args[0] != "remove") {
+		ce.Reply("**Usage**: `$cmdprefix broadcast-recipients [add|remove <address>]`")
+		return
+	}
+
+	addr := ce.Args[1]
+	if ce.Args[0] == "add" {
+		if !strings.Contains(addr, "@") {
+			ce.Reply("That doesn't look like an email address")
+			return
+		} else if err := ce.Portal.AddBroadcastRecipient(addr); err != nil {
+			ce.Reply("Failed to add recipient: %s", humanizeError(err))
+			return
+		}
+		ce.Reply("Added %s to the broadcast list", addr)
+	} else {
+		if err := ce.Portal.RemoveBroadcastRecipient(addr); err != nil {
+			ce.Reply("Failed to remove recipient: %s", humanizeError(err))
+			return
+		}
+		ce.Reply("Removed %s from the broadcast list", addr)
+	}
 }
 
 var cmdConnect = &commands.FullHandler{
@@ -113,12 +1085,41 @@ func fnDisconnect(ce *WrappedCommandEvent) {
 	}
 }
 
+var cmdConfig = &commands.FullHandler{
+	Func: wrapCommand(fnConfig),
+	Name: "config",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionAuth,
+		Description: "List your account settings.",
+	},
+}
+
+func fnConfig(ce *WrappedCommandEvent) {
+	var sb strings.Builder
+	sb.WriteString("Account settings (settings marked with \\* can't be changed by you):\n\n")
+	for _, setting := range settings {
+		value, err := ce.User.GetConfig(setting.Key)
+		if err != nil {
+			ce.Reply("Failed to get %s: %s", setting.Key, humanizeError(err))
+			return
+		}
+
+		marker := ""
+		if !setting.CanChange(ce.User) {
+			marker = "\\*"
+		}
+		_, _ = fmt.Fprintf(&sb, "* `%s`%s = %s (%s)\n", setting.Key, marker, setting.Display(value), setting.Description)
+	}
+	ce.Reply(sb.String())
+}
+
 var cmdGet = &commands.FullHandler{
 	Func: wrapCommand(fnGet),
 	Name: "get",
 	Help: commands.HelpMeta{
 		Section:     commands.HelpSectionAuth,
-		Description: "get configuration value",
+		Description: "Get an account setting.",
+		Args:        "<_key_>",
 	},
 }
 
@@ -128,15 +1129,19 @@ func fnGet(ce *WrappedCommandEvent) {
 		return
 	}
 
-	value, err := ce.User.GetConfig(ce.Args[0])
+	setting, ok := getSetting(ce.Args[0])
+	if !ok {
+		ce.Reply("Unknown setting `%s`. Use `$cmdprefix config` to list all settings.", ce.Args[0])
+		return
+	}
+
+	value, err := ce.User.GetConfig(setting.Key)
 	if err != nil {
-		ce.Reply("Error: %v", err)
-	} else {
-		if strings.Contains(ce.Args[0], "pw") && value != "" {
-			value = "***"
-		}
-		ce.Reply("%s = %s", ce.Args[0], value)
+		ce.Reply("Error: %s", humanizeError(err))
+		return
 	}
+
+	ce.Reply("%s = %s", setting.Key, setting.Display(value))
 }
 
 var cmdSet = &commands.FullHandler{
@@ -144,27 +1149,81 @@ var cmdSet = &commands.FullHandler{
 	Name: "set",
 	Help: commands.HelpMeta{
 		Section:     commands.HelpSectionAuth,
-		Description: "set configuration value",
+		Description: "Change an account setting.",
+		Args:        "<_key_> <_value_>",
 	},
 }
 
 func fnSet(ce *WrappedCommandEvent) {
-	if len(ce.Args) != 2 {
+	if len(ce.Args) < 2 {
 		ce.Reply("**Usage**: `$cmdprefix set <key> <value>`")
 		return
 	}
 
-	err := ce.User.SetConfig(ce.Args[0], ce.Args[1])
+	key, value := cutArg(ce.rawArgs())
+	setting, ok := getSetting(key)
 
-	if strings.Contains(ce.Args[0], "pw") {
-		ce.Args[1] = "***"
+	// Mistyped keys may still have a password as value
+	if !ok || isSecretKey(key) {
 		defer ce.Redact()
 	}
 
+	if !ok {
+		ce.Reply("Unknown setting `%s`. Use `$cmdprefix config` to list all settings.", key)
+		return
+	}
+
+	value, err := setting.Parse(ce.User, value)
+	if err == ErrSettingNotAllowed {
+		ce.Reply("You're not allowed to change `%s`", setting.Key)
+		return
+	} else if err != nil {
+		ce.Reply("%v. Expected %s.", err, setting.Description)
+		return
+	}
+
+	err = ce.User.SetConfig(setting.Key, value)
 	if err != nil {
-		ce.Reply("Error: %v", err)
+		ce.Reply("Error: %s", humanizeError(err))
+		return
+	}
+
+	ce.Reply("%s = %s", setting.Key, setting.Display(value))
+}
+
+var cmdSetAvatar = &commands.FullHandler{
+	Func: wrapCommand(fnSetAvatar),
+	Name: "set-avatar",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionAuth,
+		Description: "Change the avatar of your Delta Chat account.",
+	},
+	RequiresLogin: true,
+}
+
+func fnSetAvatar(ce *WrappedCommandEvent) {
+	ce.User.SetCommandState(&commands.CommandState{
+		Next:   commands.MinimalHandlerFunc(wrapCommand(fnAwaitingUpload)),
+		Action: "Avatar change",
+		Meta:   FileUploadHandler(setAvatar),
+	})
+	ce.Reply("Please upload the new avatar image, or send `$cmdprefix cancel` to cancel.")
+}
+
+func setAvatar(user *User, evt *event.Event, content *event.MessageEventContent) {
+	data, err := user.bridge.DownloadMatrixFile(content)
+	if err != nil {
+		user.log.Err(err).Msg("Failed to download avatar")
+		user.sendNotice("Failed to download avatar: %v", err)
+		return
+	}
+
+	if err = user.SetAvatar(data); err == ErrNotImage {
+		user.sendNotice("That's not an image.")
+	} else if err != nil {
+		user.sendNotice("Failed to change avatar: %s", humanizeError(err))
 	} else {
-		ce.Reply("%s = %s", ce.Args[0], ce.Args[1])
+		user.sendNotice("Avatar changed.")
 	}
 }
 
@@ -178,9 +1237,30 @@ var cmdPing = &commands.FullHandler{
 }
 
 func fnPing(ce *WrappedCommandEvent) {
-	if ce.User.AccountID == nil {
+	if !ce.User.IsLoggedIn() {
 		ce.Reply("You're not logged in")
-	} else {
-		ce.Reply("You're logged in")
+		return
+	}
+
+	acct, err := ce.User.Account()
+	if err != nil {
+		ce.Reply("Failed to get account: %v", err)
+		return
 	}
+
+	addr, _ := acct.GetConfig("configured_addr")
+
+	conn, err := acct.Connectivity()
+	if err != nil {
+		ce.Reply("Failed to get connectivity: %s", humanizeError(err))
+		return
+	}
+
+	report, err := ce.User.ConnectivityReport()
+	if err != nil {
+		ce.Reply("Failed to get connectivity report: %s", humanizeError(err))
+		return
+	}
+
+	ce.Reply("You're logged in as `%s` and %s.\n\n%s", addr, connectivityName(conn), report)
 }
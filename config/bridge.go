@@ -10,6 +10,15 @@ import (
 	"maunium.net/go/mautrix/bridge/bridgeconfig"
 )
 
+// Values of the animated_sticker target option
+const (
+	StickerTargetDisable = "disable"
+	StickerTargetPNG     = "png"
+	StickerTargetGIF     = "gif"
+	StickerTargetWebM    = "webm"
+	StickerTargetWebP    = "webp"
+)
+
 type BridgeConfig struct {
 	UsernameTemplate          string `yaml:"username_template"`
 	DisplaynameTemplate       string `yaml:"displayname_template"`
@@ -30,6 +39,8 @@ type BridgeConfig struct {
 	ResendBridgeInfo            bool `yaml:"resend_bridge_info"`
 	CustomEmojiReactions        bool `yaml:"custom_emoji_reactions"`
 	DeletePortalOnChannelDelete bool `yaml:"delete_portal_on_channel_delete"`
+	CleanupOnLogout             bool `yaml:"cleanup_on_logout"`
+	SyncMatrixProfile           bool `yaml:"sync_matrix_profile"`
 	FederateRooms               bool `yaml:"federate_rooms"`
 	AnimatedSticker             struct {
 		Target string `yaml:"target"`
@@ -40,6 +51,8 @@ type BridgeConfig struct {
 		} `yaml:"args"`
 	} `yaml:"animated_sticker"`
 
+	UnencryptedMarker string `yaml:"unencrypted_marker"`
+
 	DoublePuppetServerMap      map[string]string `yaml:"double_puppet_server_map"`
 	DoublePuppetAllowDiscovery bool              `yaml:"double_puppet_allow_discovery"`
 	LoginSharedSecretMap       map[string]string `yaml:"login_shared_secret_map"`
@@ -54,6 +67,8 @@ type BridgeConfig struct {
 		SharedSecret string `yaml:"shared_secret"`
 	} `yaml:"provisioning"`
 
+	UserConfigKeys []string `yaml:"user_config_keys"`
+
 	Permissions bridgeconfig.PermissionConfig `yaml:"permissions"`
 
 	usernameTemplate    *template.Template `yaml:"-"`
@@ -114,6 +129,16 @@ func (bc *BridgeConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		return err
 	}
 
+	switch sticker := bc.AnimatedSticker; sticker.Target {
+	case StickerTargetDisable:
+	case StickerTargetPNG, StickerTargetGIF, StickerTargetWebM, StickerTargetWebP:
+		if sticker.Args.Width <= 0 || sticker.Args.Height <= 0 || sticker.Args.FPS <= 0 {
+			return fmt.Errorf("animated sticker width, height and fps must be positive")
+		}
+	default:
+		return fmt.Errorf("unknown animated sticker target %q", sticker.Target)
+	}
+
 	return nil
 }
 
@@ -137,14 +162,28 @@ func (bc BridgeConfig) FormatUsername(userID string) string {
 	return buffer.String()
 }
 
-func (bc BridgeConfig) FormatDisplayname(user *deltachat.Contact) string {
+type DisplaynameParams struct {
+	ID           deltachat.ContactId
+	Address      string
+	DisplayName  string
+	AuthName     string
+	Name         string
+	NameOverride string
+	IsVerified   bool
+	IsBot        bool
+}
+
+func (bc BridgeConfig) FormatDisplayname(params DisplaynameParams) string {
 	var buffer strings.Builder
-	_ = bc.displaynameTemplate.Execute(&buffer, user)
+	_ = bc.displaynameTemplate.Execute(&buffer, params)
 	return buffer.String()
 }
 
 type ChannelNameParams struct {
-	Name string
+	Name               string
+	Type               string
+	MailingListAddress string
+	MemberCount        int
 }
 
 func (bc BridgeConfig) FormatChannelName(params ChannelNameParams) string {
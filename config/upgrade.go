@@ -29,12 +29,15 @@ func DoUpgrade(helper *up.Helper) {
 	helper.Copy(up.Bool, "bridge", "resend_bridge_info")
 	helper.Copy(up.Bool, "bridge", "custom_emoji_reactions")
 	helper.Copy(up.Bool, "bridge", "delete_portal_on_channel_delete")
+	helper.Copy(up.Bool, "bridge", "cleanup_on_logout")
+	helper.Copy(up.Bool, "bridge", "sync_matrix_profile")
 	helper.Copy(up.Bool, "bridge", "delete_guild_on_leave")
 	helper.Copy(up.Bool, "bridge", "federate_rooms")
 	helper.Copy(up.Str, "bridge", "animated_sticker", "target")
 	helper.Copy(up.Int, "bridge", "animated_sticker", "args", "width")
 	helper.Copy(up.Int, "bridge", "animated_sticker", "args", "height")
 	helper.Copy(up.Int, "bridge", "animated_sticker", "args", "fps")
+	helper.Copy(up.Str, "bridge", "unencrypted_marker")
 	helper.Copy(up.Map, "bridge", "double_puppet_server_map")
 	helper.Copy(up.Bool, "bridge", "double_puppet_allow_discovery")
 	helper.Copy(up.Map, "bridge", "login_shared_secret_map")
@@ -63,6 +66,7 @@ func DoUpgrade(helper *up.Helper) {
 		helper.Copy(up.Str, "bridge", "provisioning", "shared_secret")
 	}
 
+	helper.Copy(up.List, "bridge", "user_config_keys")
 	helper.Copy(up.Map, "bridge", "permissions")
 	//helper.Copy(up.Bool, "bridge", "relay", "enabled")
 	//helper.Copy(up.Bool, "bridge", "relay", "admin_only")
@@ -81,6 +85,7 @@ var SpacedBlocks = [][]string{
 	{"bridge", "management_room_text"},
 	{"bridge", "encryption"},
 	{"bridge", "provisioning"},
+	{"bridge", "user_config_keys"},
 	{"bridge", "permissions"},
 	//{"bridge", "relay"},
 	{"logging"},
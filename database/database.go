@@ -18,6 +18,7 @@ type Database struct {
 	User   *UserQuery
 	Portal *PortalQuery
 	Puppet *PuppetQuery
+	File   *FileQuery
 	/*
 		Message  *MessageQuery
 		Thread   *ThreadQuery
@@ -40,6 +41,10 @@ func New(baseDB *dbutil.Database, log maulogger.Logger) *Database {
 		db:  db,
 		log: log.Sub("Puppet"),
 	}
+	db.File = &FileQuery{
+		db:  db,
+		log: log.Sub("File"),
+	}
 	/*
 		db.Message = &MessageQuery{
 			db:  db,
@@ -61,10 +66,6 @@ func New(baseDB *dbutil.Database, log maulogger.Logger) *Database {
 			db:  db,
 			log: log.Sub("Role"),
 		}
-		db.File = &FileQuery{
-			db:  db,
-			log: log.Sub("File"),
-		}
 	*/
 	return db
 }
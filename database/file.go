@@ -0,0 +1,103 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	log "maunium.net/go/maulogger/v2"
+
+	"maunium.net/go/mautrix/crypto/attachment"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/util/dbutil"
+)
+
+// language=postgresql
+const (
+	fileSelect = "SELECT hash, encrypted, mxc, mime_type, size, timestamp, decryption_info FROM file"
+	fileInsert = `
+		INSERT INTO file (hash, encrypted, mxc, mime_type, size, timestamp, decryption_info)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (hash, encrypted) DO UPDATE SET
+			mxc = EXCLUDED.mxc,
+			mime_type = EXCLUDED.mime_type,
+			size = EXCLUDED.size,
+			timestamp = EXCLUDED.timestamp,
+			decryption_info = EXCLUDED.decryption_info
+	`
+)
+
+type FileQuery struct {
+	db  *Database
+	log log.Logger
+}
+
+func (fq *FileQuery) New() *File {
+	return &File{
+		db:  fq.db,
+		log: fq.log,
+	}
+}
+
+// Get returns the cached upload of the content with the given hash, or nil if it hasn't been uploaded.
+func (fq *FileQuery) Get(hash string, encrypted bool) *File {
+	query := fileSelect + " WHERE hash=$1 AND encrypted=$2"
+	return fq.New().Scan(fq.db.QueryRow(query, hash, encrypted))
+}
+
+// File is a blob uploaded to the Matrix media repo, identified by the SHA-256 hash of its content.
+type File struct {
+	db  *Database
+	log log.Logger
+
+	Hash      string
+	Encrypted bool
+
+	MXC       id.ContentURI
+	MimeType  string
+	Size      int64
+	Timestamp time.Time
+
+	DecryptionInfo *attachment.EncryptedFile
+}
+
+func (f *File) Scan(row dbutil.Scannable) *File {
+	var mxc string
+	var timestamp int64
+	var decryptionInfo sql.NullString
+
+	err := row.Scan(&f.Hash, &f.Encrypted, &mxc, &f.MimeType, &f.Size, &timestamp, &decryptionInfo)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			f.log.Errorln("Database scan failed:", err)
+			panic(err)
+		}
+
+		return nil
+	}
+
+	f.MXC, _ = id.ParseContentURI(mxc)
+	f.Timestamp = time.UnixMilli(timestamp)
+	if decryptionInfo.Valid {
+		if err = json.Unmarshal([]byte(decryptionInfo.String), &f.DecryptionInfo); err != nil {
+			f.log.Errorln("Failed to parse decryption info:", err)
+			panic(err)
+		}
+	}
+
+	return f
+}
+
+func (f *File) Insert() error {
+	var decryptionInfo *string
+	if f.DecryptionInfo != nil {
+		data, err := json.Marshal(f.DecryptionInfo)
+		if err != nil {
+			return err
+		}
+		decryptionInfo = strPtr(string(data))
+	}
+
+	_, err := f.db.Exec(fileInsert, f.Hash, f.Encrypted, f.MXC.String(), f.MimeType, f.Size, f.Timestamp.UnixMilli(), decryptionInfo)
+	return err
+}
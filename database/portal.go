@@ -16,7 +16,7 @@ const (
 	portalSelect = `
 		SELECT account_id, chat_id, mxid, type,
 		       plain_name, name, name_set, topic, topic_set, avatar, avatar_url, avatar_set,
-		       encrypted
+		       encrypted, protected, e2ee, list_address, read_only
 		FROM portal
 	`
 )
@@ -54,6 +54,10 @@ func (pq *PortalQuery) GetByMXID(mxid id.RoomID) *Portal {
 	return pq.get(portalSelect+" WHERE mxid=$1", mxid)
 }
 
+func (pq *PortalQuery) GetAllByAccountID(accountID deltachat.AccountId) []*Portal {
+	return pq.getAll(portalSelect+" WHERE account_id=$1", accountID)
+}
+
 func (pq *PortalQuery) getAll(query string, args ...interface{}) []*Portal {
 	rows, err := pq.db.Query(query, args...)
 	if err != nil || rows == nil {
@@ -92,6 +96,12 @@ type Portal struct {
 	AvatarURL id.ContentURI
 	AvatarSet bool
 	Encrypted bool
+	Protected bool
+	E2EE      bool
+
+	// Only set for mailing lists
+	ListAddress string
+	ReadOnly    bool
 }
 
 func (p *Portal) ID() PortalID {
@@ -105,7 +115,7 @@ func (p *Portal) Scan(row dbutil.Scannable) *Portal {
 	var avatarURL string
 
 	err := row.Scan(&p.AccountID, &p.ChatID, &p.MXID, &p.Type, &p.PlainName, &p.Name, &p.NameSet, &p.Topic, &p.TopicSet, &p.Avatar, &avatarURL, &p.AvatarSet,
-		&p.Encrypted)
+		&p.Encrypted, &p.Protected, &p.E2EE, &p.ListAddress, &p.ReadOnly)
 
 	if err != nil {
 		if err != sql.ErrNoRows {
@@ -125,16 +135,18 @@ func (p *Portal) Upsert() error {
 	query := `
 		INSERT INTO portal (account_id, chat_id, mxid, type,
 		                    plain_name, name, name_set, topic, topic_set, avatar, avatar_url, avatar_set,
-		                    encrypted)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+		                    encrypted, protected, e2ee, list_address, read_only)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17)
 		ON CONFLICT (account_id, chat_id) DO UPDATE
 		SET mxid=EXCLUDED.mxid, type=EXCLUDED.type,
 			plain_name=EXCLUDED.plain_name, name=EXCLUDED.name, name_set=EXCLUDED.name_set, topic=EXCLUDED.topic, topic_set=EXCLUDED.topic_set, avatar=EXCLUDED.avatar, avatar_url=EXCLUDED.avatar_url, avatar_set=EXCLUDED.avatar_set,
-			encrypted=EXCLUDED.encrypted
+			encrypted=EXCLUDED.encrypted, protected=EXCLUDED.protected, e2ee=EXCLUDED.e2ee,
+			list_address=EXCLUDED.list_address, read_only=EXCLUDED.read_only
 		ON CONFLICT (mxid) DO UPDATE
 		SET type=EXCLUDED.type,
 			plain_name=EXCLUDED.plain_name, name=EXCLUDED.name, name_set=EXCLUDED.name_set, topic=EXCLUDED.topic, topic_set=EXCLUDED.topic_set, avatar=EXCLUDED.avatar, avatar_url=EXCLUDED.avatar_url, avatar_set=EXCLUDED.avatar_set,
-			encrypted=EXCLUDED.encrypted
+			encrypted=EXCLUDED.encrypted, protected=EXCLUDED.protected, e2ee=EXCLUDED.e2ee,
+			list_address=EXCLUDED.list_address, read_only=EXCLUDED.read_only
 	`
 	_, err := p.db.Exec(query,
 		p.AccountID,
@@ -142,7 +154,7 @@ func (p *Portal) Upsert() error {
 		p.MXID,
 		p.Type,
 		p.PlainName, p.Name, p.NameSet, p.Topic, p.TopicSet, p.Avatar, p.AvatarURL.String(), p.AvatarSet,
-		p.Encrypted)
+		p.Encrypted, p.Protected, p.E2EE, p.ListAddress, p.ReadOnly)
 	return err
 }
 
@@ -12,22 +12,17 @@ import (
 )
 
 const (
-	puppetSelect = "SELECT account_id, contact_id, name_override, name, name_set, avatar, avatar_url, avatar_set," +
+	puppetSelect = "SELECT account_id, contact_id, name, name_set, avatar, avatar_url, avatar_set," +
 		" custom_mxid, access_token, next_batch" +
 		" FROM puppet "
 )
 
 type PuppetID struct {
-	AccountID    deltachat.AccountId
-	ContactID    deltachat.ContactId
-	NameOverride string
+	AccountID deltachat.AccountId
+	ContactID deltachat.ContactId
 }
 
 func (p PuppetID) String() string {
-	if p.NameOverride != "" {
-		return fmt.Sprintf("%d_%d_%s", p.AccountID, p.ContactID, p.NameOverride)
-	}
-
 	return fmt.Sprintf("%d_%d", p.AccountID, p.ContactID)
 }
 
@@ -44,7 +39,7 @@ func (pq *PuppetQuery) New() *Puppet {
 }
 
 func (pq *PuppetQuery) Get(puppetID PuppetID) *Puppet {
-	return pq.get(puppetSelect+" WHERE account_id=$1 AND contact_id=$2 AND name_override=$3", puppetID.AccountID, puppetID.ContactID, puppetID.NameOverride)
+	return pq.get(puppetSelect+" WHERE account_id=$1 AND contact_id=$2", puppetID.AccountID, puppetID.ContactID)
 }
 
 func (pq *PuppetQuery) GetByCustomMXID(mxid id.UserID) *Puppet {
@@ -59,6 +54,10 @@ func (pq *PuppetQuery) GetAll() []*Puppet {
 	return pq.getAll(puppetSelect)
 }
 
+func (pq *PuppetQuery) GetAllByAccountID(accountID deltachat.AccountId) []*Puppet {
+	return pq.getAll(puppetSelect+" WHERE account_id=$1", accountID)
+}
+
 func (pq *PuppetQuery) GetAllWithCustomMXID() []*Puppet {
 	return pq.getAll(puppetSelect + " WHERE custom_mxid<>''")
 }
@@ -78,13 +77,50 @@ func (pq *PuppetQuery) getAll(query string, args ...interface{}) []*Puppet {
 	return puppets
 }
 
+// LegacyOverridePuppet is a ghost that older versions created for each sender name override of a contact.
+// They're kept until the bridge has made them leave their rooms.
+type LegacyOverridePuppet struct {
+	AccountID    deltachat.AccountId
+	ContactID    deltachat.ContactId
+	NameOverride string
+}
+
+func (p LegacyOverridePuppet) String() string {
+	return fmt.Sprintf("%d_%d_%s", p.AccountID, p.ContactID, p.NameOverride)
+}
+
+func (pq *PuppetQuery) GetAllLegacyOverrides() []LegacyOverridePuppet {
+	rows, err := pq.db.Query("SELECT account_id, contact_id, name_override FROM legacy_override_puppet")
+	if err != nil || rows == nil {
+		return nil
+	}
+	defer rows.Close()
+
+	var puppets []LegacyOverridePuppet
+	for rows.Next() {
+		var p LegacyOverridePuppet
+		if err = rows.Scan(&p.AccountID, &p.ContactID, &p.NameOverride); err != nil {
+			pq.log.Errorln("Database scan failed:", err)
+			return puppets
+		}
+		puppets = append(puppets, p)
+	}
+
+	return puppets
+}
+
+func (pq *PuppetQuery) DeleteLegacyOverride(p LegacyOverridePuppet) error {
+	query := "DELETE FROM legacy_override_puppet WHERE account_id=$1 AND contact_id=$2 AND name_override=$3"
+	_, err := pq.db.Exec(query, p.AccountID, p.ContactID, p.NameOverride)
+	return err
+}
+
 type Puppet struct {
 	db  *Database
 	log log.Logger
 
-	AccountID    deltachat.AccountId
-	ContactID    deltachat.ContactId
-	NameOverride string
+	AccountID deltachat.AccountId
+	ContactID deltachat.ContactId
 
 	Name      string
 	NameSet   bool
@@ -99,9 +135,8 @@ type Puppet struct {
 
 func (p *Puppet) ID() PuppetID {
 	return PuppetID{
-		AccountID:    p.AccountID,
-		ContactID:    p.ContactID,
-		NameOverride: p.NameOverride,
+		AccountID: p.AccountID,
+		ContactID: p.ContactID,
 	}
 }
 
@@ -109,7 +144,7 @@ func (p *Puppet) Scan(row dbutil.Scannable) *Puppet {
 	var avatarURL string
 	var customMXID, accessToken, nextBatch sql.NullString
 
-	err := row.Scan(&p.AccountID, &p.ContactID, &p.NameOverride, &p.Name, &p.NameSet, &p.Avatar, &avatarURL, &p.AvatarSet,
+	err := row.Scan(&p.AccountID, &p.ContactID, &p.Name, &p.NameSet, &p.Avatar, &avatarURL, &p.AvatarSet,
 		&customMXID, &accessToken, &nextBatch)
 
 	if err != nil {
@@ -131,9 +166,9 @@ func (p *Puppet) Scan(row dbutil.Scannable) *Puppet {
 
 func (p *Puppet) Upsert() error {
 	query := `
-		INSERT INTO puppet (account_id, contact_id, name_override, name, name_set, avatar, avatar_url, avatar_set, custom_mxid, access_token, next_batch)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
-		ON CONFLICT(account_id, contact_id, name_override) DO UPDATE SET
+		INSERT INTO puppet (account_id, contact_id, name, name_set, avatar, avatar_url, avatar_set, custom_mxid, access_token, next_batch)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT(account_id, contact_id) DO UPDATE SET
 			name = EXCLUDED.name,
 			name_set = EXCLUDED.name_set,
 			avatar = EXCLUDED.avatar,
@@ -143,7 +178,16 @@ func (p *Puppet) Upsert() error {
 			access_token = EXCLUDED.access_token,
 			next_batch = EXCLUDED.next_batch
 	`
-	_, err := p.db.Exec(query, p.AccountID, p.ContactID, p.NameOverride, p.Name, p.NameSet, p.Avatar, p.AvatarURL.String(), p.AvatarSet,
+	_, err := p.db.Exec(query, p.AccountID, p.ContactID, p.Name, p.NameSet, p.Avatar, p.AvatarURL.String(), p.AvatarSet,
 		strPtr(string(p.CustomMXID)), strPtr(p.AccessToken), strPtr(p.NextBatch))
 	return err
 }
+
+func (p *Puppet) Delete() {
+	query := "DELETE FROM puppet WHERE account_id=$1 AND contact_id=$2"
+	_, err := p.db.Exec(query, p.AccountID, p.ContactID)
+	if err != nil {
+		p.log.Warnfln("Failed to delete %s: %v", p.ID(), err)
+		panic(err)
+	}
+}
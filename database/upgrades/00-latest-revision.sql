@@ -1,4 +1,4 @@
--- v0 -> v1: Latest revision
+-- v0 -> v8: Latest revision
 
 CREATE TABLE portal (
     account_id BIGINT,
@@ -15,14 +15,18 @@ CREATE TABLE portal (
     avatar_url TEXT NOT NULL,
     avatar_set BOOLEAN NOT NULL,
     encrypted  BOOLEAN NOT NULL,
+    protected  BOOLEAN NOT NULL DEFAULT false,
+    e2ee       BOOLEAN NOT NULL DEFAULT false,
+
+    list_address TEXT NOT NULL DEFAULT '',
+    read_only    BOOLEAN NOT NULL DEFAULT false,
 
     PRIMARY KEY (account_id, chat_id)
 );
 
 CREATE TABLE puppet (
-    account_id    BIGINT NOT NULL,
-    contact_id    BIGINT NOT NULL,
-    name_override TEXT NOT NULL,
+    account_id BIGINT NOT NULL,
+    contact_id BIGINT NOT NULL,
 
     name       TEXT NOT NULL,
     name_set   BOOLEAN NOT NULL,
@@ -34,11 +38,36 @@ CREATE TABLE puppet (
     access_token TEXT,
     next_batch   TEXT,
 
+    PRIMARY KEY (account_id, contact_id)
+);
+
+CREATE TABLE legacy_override_puppet (
+    account_id    BIGINT NOT NULL,
+    contact_id    BIGINT NOT NULL,
+    name_override TEXT   NOT NULL,
+
     PRIMARY KEY (account_id, contact_id, name_override)
 );
 
 CREATE TABLE "user" (
     mxid            TEXT PRIMARY KEY,
     account_id      BIGINT UNIQUE NULL,
-    management_room TEXT NOT NULL
+    management_room TEXT NOT NULL,
+
+    last_location_id  BIGINT NOT NULL DEFAULT 0,
+    synced_avatar_url TEXT   NOT NULL DEFAULT ''
+);
+
+CREATE TABLE file (
+    hash      TEXT    NOT NULL,
+    encrypted BOOLEAN NOT NULL,
+
+    mxc       TEXT   NOT NULL,
+    mime_type TEXT   NOT NULL,
+    size      BIGINT NOT NULL,
+    timestamp BIGINT NOT NULL,
+
+    decryption_info jsonb,
+
+    PRIMARY KEY (hash, encrypted)
 );
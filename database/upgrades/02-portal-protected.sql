@@ -0,0 +1,3 @@
+-- v1 -> v2: Store whether portals are protected (verified) chats
+
+ALTER TABLE portal ADD COLUMN protected BOOLEAN NOT NULL DEFAULT false;
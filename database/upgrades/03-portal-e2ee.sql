@@ -0,0 +1,3 @@
+-- v2 -> v3: Store whether the last message in portals was end-to-end encrypted
+
+ALTER TABLE portal ADD COLUMN e2ee BOOLEAN NOT NULL DEFAULT false;
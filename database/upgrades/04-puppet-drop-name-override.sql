@@ -0,0 +1,38 @@
+-- v3 -> v4: Replace sender name override ghosts with per-message profiles on the contact ghost
+
+-- The override ghosts are still in their rooms, so they're kept until the bridge has made them leave
+CREATE TABLE legacy_override_puppet (
+    account_id    BIGINT NOT NULL,
+    contact_id    BIGINT NOT NULL,
+    name_override TEXT   NOT NULL,
+
+    PRIMARY KEY (account_id, contact_id, name_override)
+);
+
+INSERT INTO legacy_override_puppet (account_id, contact_id, name_override)
+SELECT account_id, contact_id, name_override FROM puppet WHERE name_override<>'';
+
+DELETE FROM puppet WHERE name_override<>'';
+
+CREATE TABLE puppet_new (
+    account_id BIGINT NOT NULL,
+    contact_id BIGINT NOT NULL,
+
+    name       TEXT NOT NULL,
+    name_set   BOOLEAN NOT NULL,
+    avatar     TEXT NOT NULL,
+    avatar_url TEXT NOT NULL,
+    avatar_set BOOLEAN NOT NULL,
+
+    custom_mxid  TEXT,
+    access_token TEXT,
+    next_batch   TEXT,
+
+    PRIMARY KEY (account_id, contact_id)
+);
+
+INSERT INTO puppet_new (account_id, contact_id, name, name_set, avatar, avatar_url, avatar_set, custom_mxid, access_token, next_batch)
+SELECT account_id, contact_id, name, name_set, avatar, avatar_url, avatar_set, custom_mxid, access_token, next_batch FROM puppet;
+
+DROP TABLE puppet;
+ALTER TABLE puppet_new RENAME TO puppet;
@@ -0,0 +1,15 @@
+-- v4 -> v5: Cache uploaded media by content hash
+
+CREATE TABLE file (
+    hash      TEXT    NOT NULL,
+    encrypted BOOLEAN NOT NULL,
+
+    mxc       TEXT   NOT NULL,
+    mime_type TEXT   NOT NULL,
+    size      BIGINT NOT NULL,
+    timestamp BIGINT NOT NULL,
+
+    decryption_info jsonb,
+
+    PRIMARY KEY (hash, encrypted)
+);
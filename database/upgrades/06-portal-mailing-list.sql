@@ -0,0 +1,4 @@
+-- v5 -> v6: Store the address and read-only state of mailing list portals
+
+ALTER TABLE portal ADD COLUMN list_address TEXT NOT NULL DEFAULT '';
+ALTER TABLE portal ADD COLUMN read_only BOOLEAN NOT NULL DEFAULT false;
@@ -0,0 +1,3 @@
+-- v6 -> v7: Store the last streamed location bridged as a beacon update
+
+ALTER TABLE "user" ADD COLUMN last_location_id BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,3 @@
+-- v7 -> v8: Store the Matrix avatar last synced to the Delta Chat account
+
+ALTER TABLE "user" ADD COLUMN synced_avatar_url TEXT NOT NULL DEFAULT '';
@@ -22,15 +22,15 @@ func (uq *UserQuery) New() *User {
 	}
 }
 
-const userSelect = `SELECT mxid, account_id, management_room FROM "user" WHERE`
+const userSelect = `SELECT mxid, account_id, management_room, last_location_id, synced_avatar_url FROM "user" WHERE`
 
 func (uq *UserQuery) GetByMXID(userID id.UserID) *User {
-	query := `SELECT mxid, account_id, management_room FROM "user" WHERE mxid=$1`
+	query := `SELECT mxid, account_id, management_room, last_location_id, synced_avatar_url FROM "user" WHERE mxid=$1`
 	return uq.New().Scan(uq.db.QueryRow(query, userID))
 }
 
 func (uq *UserQuery) GetByAccountID(id deltachat.AccountId) *User {
-	query := `SELECT mxid, account_id, management_room FROM "user" WHERE account_id=$1`
+	query := `SELECT mxid, account_id, management_room, last_location_id, synced_avatar_url FROM "user" WHERE account_id=$1`
 	return uq.New().Scan(uq.db.QueryRow(query, id))
 }
 
@@ -42,9 +42,11 @@ type User struct {
 	db  *Database
 	log log.Logger
 
-	MXID           id.UserID
-	AccountID      *deltachat.AccountId
-	ManagementRoom id.RoomID
+	MXID            id.UserID
+	AccountID       *deltachat.AccountId
+	ManagementRoom  id.RoomID
+	LastLocationID  uint64
+	SyncedAvatarURL id.ContentURI
 }
 
 func (uq *UserQuery) getAll(query string, args ...interface{}) []*User {
@@ -63,7 +65,8 @@ func (uq *UserQuery) getAll(query string, args ...interface{}) []*User {
 }
 
 func (u *User) Scan(row dbutil.Scannable) *User {
-	err := row.Scan(&u.MXID, &u.AccountID, &u.ManagementRoom)
+	var syncedAvatarURL string
+	err := row.Scan(&u.MXID, &u.AccountID, &u.ManagementRoom, &u.LastLocationID, &syncedAvatarURL)
 	if err != nil {
 		if err != sql.ErrNoRows {
 			u.log.Errorln("Database scan failed:", err)
@@ -71,12 +74,13 @@ func (u *User) Scan(row dbutil.Scannable) *User {
 		}
 		return nil
 	}
+	u.SyncedAvatarURL, _ = id.ParseContentURI(syncedAvatarURL)
 	return u
 }
 
 func (u *User) Insert() {
-	query := `INSERT INTO "user" (mxid, account_id, management_room) VALUES ($1, $2, $3)`
-	_, err := u.db.Exec(query, u.MXID, u.AccountID, u.ManagementRoom)
+	query := `INSERT INTO "user" (mxid, account_id, management_room, last_location_id, synced_avatar_url) VALUES ($1, $2, $3, $4, $5)`
+	_, err := u.db.Exec(query, u.MXID, u.AccountID, u.ManagementRoom, u.LastLocationID, u.SyncedAvatarURL.String())
 	if err != nil {
 		u.log.Warnfln("Failed to insert %s: %v", u.MXID, err)
 		panic(err)
@@ -84,8 +88,8 @@ func (u *User) Insert() {
 }
 
 func (u *User) Update() {
-	query := `UPDATE "user" SET account_id=$1, management_room=$2 WHERE mxid=$3`
-	_, err := u.db.Exec(query, u.AccountID, u.ManagementRoom, u.MXID)
+	query := `UPDATE "user" SET account_id=$1, management_room=$2, last_location_id=$3, synced_avatar_url=$4 WHERE mxid=$5`
+	_, err := u.db.Exec(query, u.AccountID, u.ManagementRoom, u.LastLocationID, u.SyncedAvatarURL.String(), u.MXID)
 	if err != nil {
 		u.log.Warnfln("Failed to update %q: %v", u.MXID, err)
 		panic(err)
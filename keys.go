@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/deltachat/deltachat-rpc-client-go/deltachat"
+)
+
+var (
+	ErrKeyNotFound         = errors.New("key not found in export")
+	ErrNotSetupMessage     = errors.New("not an Autocrypt Setup Message")
+	ErrNotSelfSetupMessage = errors.New("Autocrypt Setup Message was not sent by yourself")
+)
+
+// ExportSecretKey exports the account's default secret key into dir and returns its path.
+func (user *User) ExportSecretKey(dir string) (string, error) {
+	return user.exportKey(dir, "private-key-")
+}
+
+// ImportSecretKeys imports all secret keys found in dir. The last imported key becomes the
+// default key of the account.
+func (user *User) ImportSecretKeys(dir string) error {
+	acct, err := user.Account()
+	if err != nil {
+		return err
+	}
+
+	return acct.ImportSelfKeys(dir)
+}
+
+// Fingerprint returns the fingerprint of the account's default OpenPGP key.
+func (user *User) Fingerprint() (string, error) {
+	dir, err := os.MkdirTemp("", "mautrix-deltachat-keys-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+
+	path, err := user.exportKey(dir, "public-key-")
+	if err != nil {
+		return "", err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	return publicKeyFingerprint(f)
+}
+
+func (user *User) exportKey(dir, prefix string) (string, error) {
+	acct, err := user.Account()
+	if err != nil {
+		return "", err
+	}
+
+	if err = acct.ExportSelfKeys(dir); err != nil {
+		return "", err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+
+	// Non-default keys are exported with their database ID instead of "default"
+	var path string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ".asc") {
+			continue
+		} else if name == prefix+"default.asc" {
+			return filepath.Join(dir, name), nil
+		}
+		path = filepath.Join(dir, name)
+	}
+
+	if path == "" {
+		return "", ErrKeyNotFound
+	}
+
+	return path, nil
+}
+
+// SendAutocryptSetupMessage sends an Autocrypt Setup Message containing the account's secret key
+// to the self-chat and returns the setup code needed to decrypt it.
+func (user *User) SendAutocryptSetupMessage() (string, error) {
+	acct, err := user.Account()
+	if err != nil {
+		return "", err
+	}
+
+	return acct.InitiateAutocryptKeyTransfer()
+}
+
+// AcceptAutocryptSetupMessage decrypts the given Autocrypt Setup Message with the setup code and
+// imports the contained secret key as the account's default key.
+func (user *User) AcceptAutocryptSetupMessage(msgID deltachat.MsgId, setupCode string) error {
+	acct, err := user.Account()
+	if err != nil {
+		return err
+	}
+
+	msg := &deltachat.Message{Account: acct, Id: msgID}
+	snap, err := msg.Snapshot()
+	if err != nil {
+		return err
+	} else if !snap.IsSetupmessage {
+		return ErrNotSetupMessage
+	} else if snap.FromId != deltachat.CONTACT_SELF {
+		return ErrNotSelfSetupMessage
+	}
+
+	return msg.ContinueAutocryptKeyTransfer(setupCode)
+}
+
+// ContactEncryptionInfo returns the core's encryption summary for a contact, which includes the
+// fingerprints of both the account and the contact, and whether the contact is verified.
+func (user *User) ContactEncryptionInfo(addr string) (string, bool, error) {
+	acct, err := user.Account()
+	if err != nil {
+		return "", false, err
+	}
+
+	contact, err := acct.GetContactByAddr(addr)
+	if err != nil {
+		return "", false, err
+	} else if contact == nil {
+		return "", false, fmt.Errorf("no contact with address %s", addr)
+	}
+
+	snap, err := contact.Snapshot()
+	if err != nil {
+		return "", false, err
+	}
+
+	info, err := contact.EncryptionInfo()
+	if err != nil {
+		return "", false, err
+	}
+
+	return info, snap.IsVerified, nil
+}
+
+// publicKeyFingerprint returns the fingerprint of the primary key of the first key in an armored OpenPGP
+// key file.
+func publicKeyFingerprint(r io.Reader) (string, error) {
+	keys, err := openpgp.ReadArmoredKeyRing(r)
+	if err != nil {
+		return "", err
+	} else if len(keys) == 0 {
+		return "", ErrKeyNotFound
+	}
+
+	return formatFingerprint(fmt.Sprintf("%X", keys[0].PrimaryKey.Fingerprint)), nil
+}
+
+// formatFingerprint groups the hex fingerprint in blocks of four like Delta Chat displays it.
+func formatFingerprint(hex string) string {
+	var groups []string
+	for i := 0; i < len(hex); i += 4 {
+		end := i + 4
+		if end > len(hex) {
+			end = len(hex)
+		}
+		groups = append(groups, hex[i:end])
+	}
+	return strings.Join(groups, " ")
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/deltachat/deltachat-rpc-client-go/deltachat"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-deltachat/database"
+)
+
+var ErrInvalidGeoURI = errors.New("invalid geo URI")
+
+var (
+	StateBeaconInfo = event.Type{Type: "org.matrix.msc3672.beacon_info", Class: event.StateEventType}
+	EventBeacon     = event.Type{Type: "org.matrix.msc3672.beacon", Class: event.MessageEventType}
+)
+
+// Receivers of a Delta Chat location stream don't know how long it lasts, so beacons are started with a fixed
+// timeout and restarted if the stream continues after it.
+const beaconTimeout = time.Hour
+
+// location is a location as returned by the core's get_locations.
+type location struct {
+	LocationId    uint64
+	IsIndependent bool
+	Latitude      float64
+	Longitude     float64
+	Accuracy      float64
+	Timestamp     int64
+	ContactId     deltachat.ContactId
+	MsgId         deltachat.MsgId
+	ChatId        deltachat.ChatId
+	Marker        *string
+}
+
+// GeoURI formats the location as an RFC 5870 geo URI.
+func (loc *location) GeoURI() string {
+	uri := fmt.Sprintf("geo:%s,%s", formatCoordinate(loc.Latitude), formatCoordinate(loc.Longitude))
+	if loc.Accuracy > 0 {
+		uri += ";u=" + formatCoordinate(loc.Accuracy)
+	}
+	return uri
+}
+
+func formatCoordinate(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// parseGeoURI returns the latitude and longitude of a geo URI like geo:52.52,13.405;u=35.
+func parseGeoURI(uri string) (float64, float64, error) {
+	if !strings.HasPrefix(uri, "geo:") {
+		return 0, 0, ErrInvalidGeoURI
+	}
+
+	coords, _, _ := strings.Cut(strings.TrimPrefix(uri, "geo:"), ";")
+	parts := strings.Split(coords, ",")
+	if len(parts) < 2 {
+		return 0, 0, ErrInvalidGeoURI
+	}
+
+	lat, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil || lat < -90 || lat > 90 {
+		return 0, 0, ErrInvalidGeoURI
+	}
+
+	lon, err := strconv.ParseFloat(parts[1], 64)
+	if err != nil || lon < -180 || lon > 180 {
+		return 0, 0, ErrInvalidGeoURI
+	}
+
+	return lat, lon, nil
+}
+
+// getLocations returns the locations known by the core since the given unix timestamp. The chat and contact
+// filters are optional.
+func getLocations(acct *deltachat.Account, chatID *deltachat.ChatId, contactID *deltachat.ContactId, since int64) ([]*location, error) {
+	var locations []*location
+	err := acct.Manager.Rpc.CallResult(&locations, "get_locations", acct.Id, chatID, contactID, since, 0)
+	return locations, err
+}
+
+// getMessageLocation returns the location attached to a message.
+func (portal *Portal) getMessageLocation(msg *deltachat.MsgSnapshot) (*location, error) {
+	chat, err := portal.Chat()
+	if err != nil {
+		return nil, err
+	}
+
+	locations, err := getLocations(chat.Account, &msg.ChatId, &msg.FromId, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, loc := range locations {
+		if loc.MsgId == msg.Id {
+			return loc, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// sendLocation sends a message with an attached location as m.location. The body is the bridged message text,
+// the location description is the text as written by the sender.
+func (portal *Portal) sendLocation(intent *appservice.IntentAPI, loc *location, text, description string, extra map[string]interface{}) {
+	geoURI := loc.GeoURI()
+	body := text
+	if body == "" {
+		body = "Location: " + geoURI
+	}
+
+	locationExtra := make(map[string]interface{}, len(extra)+3)
+	for key, value := range extra {
+		locationExtra[key] = value
+	}
+	locationExtra["org.matrix.msc3488.location"] = map[string]interface{}{
+		"uri":         geoURI,
+		"description": description,
+	}
+	locationExtra["org.matrix.msc3488.asset"] = map[string]interface{}{"type": "m.pin"}
+	locationExtra["org.matrix.msc3488.ts"] = loc.Timestamp * 1000
+
+	_, err := portal.sendMessageEvent(intent, event.EventMessage, &event.Content{
+		Parsed: &event.MessageEventContent{
+			MsgType: event.MsgLocation,
+			Body:    body,
+			GeoURI:  geoURI,
+		},
+		Raw: locationExtra,
+	})
+	if err != nil {
+		portal.log.Err(err).Msg("Failed to send location")
+	}
+}
+
+// sendMatrixLocation sends a Matrix m.location event to Delta Chat as a message with the coordinates attached.
+func (portal *Portal) sendMatrixLocation(content *event.MessageEventContent) error {
+	lat, lon, err := parseGeoURI(content.GeoURI)
+	if err != nil {
+		return err
+	}
+
+	chat, err := portal.Chat()
+	if err != nil {
+		return err
+	}
+
+	_, err = chat.SendMsg(deltachat.MsgData{
+		Text:     content.Body,
+		Location: &[2]float64{lat, lon},
+	})
+	return err
+}
+
+// beacon is a live location share started in a portal for a contact who streams their location.
+type beacon struct {
+	eventID id.EventID
+	expires time.Time
+}
+
+// handleLocationChanged bridges streamed locations that weren't bridged yet as MSC3489 beacon updates. Locations
+// attached to single messages are bridged with the message instead. The ID of the last bridged location is saved,
+// so locations aren't bridged again after a restart. This is only called from the account event loop, so the
+// last location ID needs no locking.
+func (user *User) handleLocationChanged(acct *deltachat.Account) {
+	// Location IDs are assigned in the order the core stores them, but a location may be stored later than a
+	// newer one of another contact, so the IDs are compared instead of the timestamps.
+	locations, err := getLocations(acct, nil, nil, time.Now().Add(-beaconTimeout).Unix())
+	if err != nil {
+		user.log.Err(err).Msg("Failed to get locations")
+		return
+	}
+
+	sort.Slice(locations, func(i, j int) bool {
+		return locations[i].LocationId < locations[j].LocationId
+	})
+
+	lastLocationID := user.LastLocationID
+	for _, loc := range locations {
+		if loc.LocationId <= user.LastLocationID {
+			continue
+		}
+		user.LastLocationID = loc.LocationId
+		if loc.IsIndependent || loc.ContactId == deltachat.CONTACT_SELF {
+			continue
+		}
+
+		portal := user.bridge.GetExistingPortalByID(database.PortalID{AccountID: acct.Id, ChatID: loc.ChatId})
+		if portal == nil || portal.MXID == "" {
+			continue
+		}
+		portal.ReceiveDeltaChatLocation(loc)
+	}
+
+	if user.LastLocationID != lastLocationID {
+		user.Update()
+	}
+}
+
+// sendBeaconLocation sends a streamed location as a beacon update, starting a new beacon if there is none or
+// the last one expired.
+func (portal *Portal) sendBeaconLocation(loc *location) {
+	puppet := portal.bridge.GetPuppetByID(database.PuppetID{AccountID: portal.AccountID, ContactID: loc.ContactId})
+	intent := puppet.DefaultIntent()
+
+	current, ok := portal.beacons[loc.ContactId]
+	if !ok || time.Now().After(current.expires) {
+		var err error
+		current, err = portal.startBeacon(intent, puppet)
+		if err != nil {
+			portal.log.Err(err).Msg("Failed to start beacon")
+			return
+		}
+	}
+
+	_, err := portal.sendMessageEvent(intent, EventBeacon, &event.Content{
+		Raw: map[string]interface{}{
+			"m.relates_to": map[string]interface{}{
+				"rel_type": event.RelReference,
+				"event_id": current.eventID,
+			},
+			"org.matrix.msc3488.location": map[string]interface{}{
+				"uri": loc.GeoURI(),
+			},
+			"org.matrix.msc3488.ts": loc.Timestamp * 1000,
+		},
+	})
+	if err != nil {
+		portal.log.Err(err).Msg("Failed to send beacon location")
+	}
+}
+
+// startBeacon sends the beacon_info state event that the location updates of a contact refer to.
+func (portal *Portal) startBeacon(intent *appservice.IntentAPI, puppet *Puppet) (*beacon, error) {
+	if err := portal.allowBeacon(puppet); err != nil {
+		portal.log.Warn().Err(err).Msg("Failed to raise ghost power level for beacons")
+	}
+
+	now := time.Now()
+	resp, err := intent.SendStateEvent(portal.MXID, StateBeaconInfo, puppet.MXID.String(), map[string]interface{}{
+		"description":              puppet.Name,
+		"live":                     true,
+		"timeout":                  beaconTimeout.Milliseconds(),
+		"org.matrix.msc3488.ts":    now.UnixMilli(),
+		"org.matrix.msc3488.asset": map[string]interface{}{"type": "m.self"},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if portal.beacons == nil {
+		portal.beacons = make(map[deltachat.ContactId]*beacon)
+	}
+	started := &beacon{eventID: resp.EventID, expires: now.Add(beaconTimeout)}
+	portal.beacons[puppet.ContactID] = started
+
+	return started, nil
+}
+
+// allowBeacon raises the power level of the ghost to the one required for beacon_info state events, so that it
+// can share its location without letting everyone else in the room send state events.
+func (portal *Portal) allowBeacon(puppet *Puppet) error {
+	return portal.ensureUserLevel(puppet.MXID, func(levels *event.PowerLevelsEventContent) int {
+		return levels.GetEventLevel(StateBeaconInfo)
+	})
+}
@@ -1,21 +1,31 @@
 package main
 
 import (
+	"crypto/sha256"
 	_ "embed"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
+	"path/filepath"
 	"runtime"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/deltachat/deltachat-rpc-client-go/deltachat"
 	"github.com/rs/zerolog"
 
 	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
 	"maunium.net/go/mautrix/bridge"
-	"maunium.net/go/mautrix/bridge/commands"
+	"maunium.net/go/mautrix/bridge/bridgeconfig"
+	"maunium.net/go/mautrix/crypto/attachment"
+	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/util"
 	"maunium.net/go/mautrix/util/configupgrade"
 
 	"go.mau.fi/mautrix-deltachat/config"
@@ -41,7 +51,7 @@ type DeltaChatBridge struct {
 	RPC            *deltachat.RpcIO
 	AccountManager *deltachat.AccountManager
 
-	//provisioning *ProvisioningAPI
+	provisioning *ProvisioningAPI
 
 	usersByMXID      map[id.UserID]*User
 	usersByAccountID map[deltachat.AccountId]*User
@@ -58,7 +68,13 @@ type DeltaChatBridge struct {
 	puppetsByCustomMXID map[id.UserID]*Puppet
 	puppetsLock         sync.Mutex
 
-	//attachmentTransfers *util.SyncMap[attachmentKey, *util.ReturnableOnce[*database.File]]
+	attachmentTransfers *util.SyncMap[attachmentKey, *util.ReturnableOnce[*database.File]]
+}
+
+// attachmentKey identifies an upload in progress, so concurrent uploads of the same content only happen once.
+type attachmentKey struct {
+	Hash    string
+	Encrypt bool
 }
 
 func (br *DeltaChatBridge) GetExampleConfig() string {
@@ -78,8 +94,10 @@ func (br *DeltaChatBridge) Init() {
 	br.RPC.Stderr = ZStderr(br.ZLog.With().Str("component", "deltachat-core").Logger())
 	br.AccountManager = &deltachat.AccountManager{Rpc: br.RPC}
 
-	br.CommandProcessor = commands.NewProcessor(&br.Bridge)
+	br.CommandProcessor = NewCommandProcessor(br)
 	br.RegisterCommands()
+	br.EventProcessor.On(event.EventMessage, br.handleManagementRoomFile)
+	br.EventProcessor.On(event.StateMember, br.handleMemberEvent)
 
 	//matrixHTMLParser.PillConverter = br.pillConverter
 
@@ -102,6 +120,12 @@ func (br *DeltaChatBridge) Start() {
 		br.ZLog.Fatal().Err(err).Msg("Failed to communicate with Delta Chat core")
 	}
 
+	if br.Config.Bridge.Provisioning.SharedSecret != "disable" {
+		br.provisioning = newProvisioningAPI(br)
+	}
+
+	go br.cleanupLegacyOverridePuppets()
+
 	// for each user we already know, import anything we've might've missed
 	accounts, err := br.AccountManager.Accounts()
 	if err != nil {
@@ -128,11 +152,6 @@ func (br *DeltaChatBridge) Start() {
 			br.ZLog.Err(err).Msg("Failed to connect user")
 		}
 	}
-	/*
-		if br.Config.Bridge.Provisioning.SharedSecret != "disable" {
-			br.provisioning = newProvisioningAPI(br)
-		}
-	*/
 	//go br.startUsers()
 }
 
@@ -149,15 +168,12 @@ func (br *DeltaChatBridge) Stop() {
 }
 
 func (br *DeltaChatBridge) GetAllIPortals() (iportals []bridge.Portal) {
-	/*
-		portals := br.GetAllPortals()
-		iportals = make([]bridge.Portal, len(portals))
-		for i, portal := range portals {
-			iportals[i] = portal
-		}
-		return iportals
-	*/
-	return []bridge.Portal{}
+	portals := br.GetAllPortals()
+	iportals = make([]bridge.Portal, len(portals))
+	for i, portal := range portals {
+		iportals[i] = portal
+	}
+	return iportals
 }
 
 func (br *DeltaChatBridge) GetIPortal(mxid id.RoomID) bridge.Portal {
@@ -185,6 +201,29 @@ func (br *DeltaChatBridge) GetIGhost(mxid id.UserID) bridge.Ghost {
 	return br.GetPuppetByMXID(mxid)
 }
 
+// handleManagementRoomFile passes files uploaded to the management room to the command waiting for them. The
+// command processor only handles text messages, so this applies the same checks as the Matrix handler does
+// before running commands.
+func (br *DeltaChatBridge) handleManagementRoomFile(evt *event.Event) {
+	if evt.Sender == br.Bot.UserID || br.IsGhost(evt.Sender) {
+		return
+	} else if !evt.Mautrix.WasEncrypted && br.Config.Bridge.Encryption.Require {
+		return
+	}
+
+	content := evt.Content.AsMessage()
+	if content.MsgType != event.MsgImage && content.MsgType != event.MsgFile {
+		return
+	}
+
+	user := br.GetUserByMXID(evt.Sender)
+	if user == nil || user.GetManagementRoomID() != evt.RoomID || user.GetPermissionLevel() < bridgeconfig.PermissionLevelUser {
+		return
+	}
+
+	go user.handleManagementRoomFile(evt, content)
+}
+
 func (br *DeltaChatBridge) CreatePrivatePortal(id id.RoomID, user bridge.User, ghost bridge.Ghost) {
 	//TODO implement
 }
@@ -201,6 +240,8 @@ func main() {
 
 		puppets:             make(map[database.PuppetID]*Puppet),
 		puppetsByCustomMXID: make(map[id.UserID]*Puppet),
+
+		attachmentTransfers: util.NewSyncMap[attachmentKey, *util.ReturnableOnce[*database.File]](),
 	}
 	br.Bridge = bridge.Bridge{
 		Name:         "mautrix-deltachat",
@@ -224,27 +265,343 @@ func main() {
 	br.Main()
 }
 
-func (br *DeltaChatBridge) UploadBlobWithName(path string, fileName string) (id.ContentURI, error) {
-	data, err := os.ReadFile(path)
+var ErrEncryptionDisabled = errors.New("room is encrypted, but encryption is disabled in the bridge")
+
+// FileTooLargeError is returned when a blob is larger than the homeserver's upload size limit.
+type FileTooLargeError struct {
+	Size  int64
+	Limit int64
+}
+
+func (err FileTooLargeError) Error() string {
+	return fmt.Sprintf("file is %s, but the homeserver only accepts files up to %s", formatSize(err.Size), formatSize(err.Limit))
+}
+
+// UploadBlobWithName streams a blob file to the media repo, encrypting it for encrypted rooms if encrypt is set.
+// Content that was uploaded before is taken from the file cache instead. If mimeType is empty, it's detected from
+// the start of the file.
+func (br *DeltaChatBridge) UploadBlobWithName(path, fileName, mimeType string, encrypt bool) (*database.File, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	size := stat.Size()
+	if limit := br.MediaConfig.UploadSize; limit > 0 && size > limit {
+		return nil, FileTooLargeError{Size: size, Limit: limit}
+	}
+
+	hash, err := hashFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	key := attachmentKey{Hash: hash, Encrypt: encrypt}
+	if cached := br.DB.File.Get(key.Hash, key.Encrypt); cached != nil {
+		return cached, nil
+	}
+
+	once, _ := br.attachmentTransfers.GetOrSet(key, &util.ReturnableOnce[*database.File]{})
+	defer br.attachmentTransfers.Delete(key)
+
+	return once.Do(func() (*database.File, error) {
+		if mimeType == "" {
+			mimeType, err = detectMimeType(file)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		mxc, decryptionInfo, err := br.uploadMedia(br.Bot, mautrix.ReqUploadMedia{
+			Content:       file,
+			ContentLength: size,
+			ContentType:   mimeType,
+			FileName:      fileName,
+		}, key.Encrypt)
+		if err != nil {
+			return nil, err
+		}
+
+		dbFile := br.DB.File.New()
+		dbFile.Hash = key.Hash
+		dbFile.Encrypted = key.Encrypt
+		dbFile.MXC = mxc
+		dbFile.MimeType = mimeType
+		dbFile.Size = size
+		dbFile.Timestamp = time.Now()
+		dbFile.DecryptionInfo = decryptionInfo
+		if err = dbFile.Insert(); err != nil {
+			br.ZLog.Warn().Err(err).Str("mxc", dbFile.MXC.String()).Msg("Failed to cache uploaded file")
+		}
+
+		return dbFile, nil
+	})
+}
+
+func (br *DeltaChatBridge) UploadBlob(path string) (id.ContentURI, error) {
+	file, err := br.UploadBlobWithName(path, "", "", false)
 	if err != nil {
 		return id.ContentURI{}, err
 	}
+	return file.MXC, nil
+}
+
+// hashFile returns the hex-encoded SHA-256 hash of the file's content and rewinds it.
+func hashFile(file *os.File) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// detectMimeType sniffs the MIME type from the first 512 bytes of the file and rewinds it.
+func detectMimeType(file *os.File) (string, error) {
+	header := make([]byte, 512)
+	n, err := io.ReadFull(file, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	return http.DetectContentType(header[:n]), nil
+}
+
+// formatSize formats a byte count for humans, e.g. 1.5 MiB.
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+// DownloadMatrixFile downloads and, if necessary, decrypts the file of a Matrix media message.
+func (br *DeltaChatBridge) DownloadMatrixFile(content *event.MessageEventContent) ([]byte, error) {
+	url := content.URL
+	if content.File != nil {
+		url = content.File.URL
+	}
+
+	mxc, err := url.Parse()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := br.Bot.DownloadBytes(mxc)
+	if err != nil {
+		return nil, err
+	}
+
+	if content.File != nil {
+		err = content.File.DecryptInPlace(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return data, nil
+}
+
+// DownloadMatrixFileToTemp downloads a Matrix media message into a new temporary file and returns its path.
+// The caller is responsible for removing the file.
+func (br *DeltaChatBridge) DownloadMatrixFileToTemp(content *event.MessageEventContent, pattern string) (string, error) {
+	data, err := br.DownloadMatrixFile(content)
+	if err != nil {
+		return "", err
+	}
+
+	file, err := os.CreateTemp("", pattern)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	if _, err = file.Write(data); err != nil {
+		_ = os.Remove(file.Name())
+		return "", err
+	}
+
+	return file.Name(), nil
+}
+
+// DownloadMatrixFileToTempDir downloads a Matrix media message into a new temporary directory and returns the
+// path of the file, which keeps the file name of the message, as the core sends attachments with the name of
+// their file. The caller is responsible for removing the directory.
+func (br *DeltaChatBridge) DownloadMatrixFileToTempDir(content *event.MessageEventContent) (string, error) {
+	data, err := br.DownloadMatrixFile(content)
+	if err != nil {
+		return "", err
+	}
+
+	dir, err := os.MkdirTemp("", "mautrix-deltachat-media-")
+	if err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(dir, matrixFileName(content))
+	if err = os.WriteFile(path, data, 0600); err != nil {
+		_ = os.RemoveAll(dir)
+		return "", err
+	}
+
+	return path, nil
+}
+
+// matrixFileName returns a file name for a Matrix media message that is safe to use as a path element.
+func matrixFileName(content *event.MessageEventContent) string {
+	// The body is a caption if the file name is set separately
+	name := content.FileName
+	if name == "" {
+		name = content.Body
+	}
+
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	if name == "." || name == "/" || name == ".." {
+		mimeType := ""
+		if content.Info != nil {
+			mimeType = content.Info.MimeType
+		}
+		name = "file" + fileExtension("", mimeType)
+	}
+
+	return name
+}
 
-	req := mautrix.ReqUploadMedia{
+// UploadMatrixMedia uploads data for a media message into content, encrypting it if the room is encrypted.
+// Note that the data is encrypted in place.
+func (br *DeltaChatBridge) UploadMatrixMedia(intent *appservice.IntentAPI, roomID id.RoomID, data []byte, fileName, mimeType string, content *event.MessageEventContent) error {
+	info := content.GetInfo()
+	info.MimeType = mimeType
+	info.Size = len(data)
+
+	mxc, file, err := br.uploadMedia(intent, mautrix.ReqUploadMedia{
 		ContentBytes:  data,
 		ContentLength: int64(len(data)),
-		ContentType:   http.DetectContentType(data),
+		ContentType:   mimeType,
 		FileName:      fileName,
+	}, br.IsRoomEncrypted(roomID))
+	if err != nil {
+		return err
 	}
 
-	resp, err := br.Bot.UploadMedia(req)
+	setMediaURL(content, mxc, file)
+	return nil
+}
+
+// UploadMatrixFile streams a file for a media message into content, encrypting it if the room is encrypted.
+func (br *DeltaChatBridge) UploadMatrixFile(intent *appservice.IntentAPI, roomID id.RoomID, path, fileName, mimeType string, content *event.MessageEventContent) error {
+	file, err := os.Open(path)
 	if err != nil {
-		return id.ContentURI{}, err
+		return err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	size := stat.Size()
+	if limit := br.MediaConfig.UploadSize; limit > 0 && size > limit {
+		return FileTooLargeError{Size: size, Limit: limit}
 	}
 
-	return resp.ContentURI, nil
+	info := content.GetInfo()
+	info.MimeType = mimeType
+	info.Size = int(size)
+
+	mxc, decryptionInfo, err := br.uploadMedia(intent, mautrix.ReqUploadMedia{
+		Content:       file,
+		ContentLength: size,
+		ContentType:   mimeType,
+		FileName:      fileName,
+	}, br.IsRoomEncrypted(roomID))
+	if err != nil {
+		return err
+	}
+
+	setMediaURL(content, mxc, decryptionInfo)
+	return nil
 }
 
-func (br *DeltaChatBridge) UploadBlob(path string) (id.ContentURI, error) {
-	return br.UploadBlobWithName(path, "")
+// uploadMedia uploads media to the media repo, encrypting it first if encrypt is set. Content given as bytes is
+// encrypted in place, streamed content is encrypted while it's uploaded.
+func (br *DeltaChatBridge) uploadMedia(intent *appservice.IntentAPI, req mautrix.ReqUploadMedia, encrypt bool) (id.ContentURI, *attachment.EncryptedFile, error) {
+	var file *attachment.EncryptedFile
+	var encrypted io.ReadCloser
+	if encrypt {
+		file = attachment.NewEncryptedFile()
+		if req.ContentBytes != nil {
+			file.EncryptInPlace(req.ContentBytes)
+		} else {
+			// AES-CTR doesn't change the size, and the hash is only known after the whole stream is read
+			encrypted = file.EncryptStream(req.Content)
+			req.Content = encrypted
+		}
+		req.ContentType = "application/octet-stream"
+		req.FileName = ""
+	}
+
+	resp, err := intent.UploadMedia(req)
+	if err != nil {
+		return id.ContentURI{}, nil, err
+	}
+
+	if encrypted != nil {
+		if err = encrypted.Close(); err != nil {
+			return id.ContentURI{}, nil, err
+		}
+	}
+
+	return resp.ContentURI, file, nil
+}
+
+// IsRoomEncrypted returns whether events and media sent to the room have to be encrypted. Portals save it
+// themselves, as the state store may not have seen the encryption event of a new portal yet. The state store
+// is checked as well for other rooms like management rooms and portals that were encrypted later.
+func (br *DeltaChatBridge) IsRoomEncrypted(roomID id.RoomID) bool {
+	if portal := br.GetPortalByMXID(roomID); portal != nil && portal.IsEncrypted() {
+		return true
+	}
+	return br.StateStore.IsEncrypted(roomID)
+}
+
+// SendMessageEvent sends a message event, encrypting it if the room is encrypted. Events are never sent
+// unencrypted to encrypted rooms, so this fails if encryption is disabled in the bridge.
+func (br *DeltaChatBridge) SendMessageEvent(intent *appservice.IntentAPI, roomID id.RoomID, eventType event.Type, content *event.Content) (*mautrix.RespSendEvent, error) {
+	if br.IsRoomEncrypted(roomID) {
+		if br.Crypto == nil {
+			return nil, ErrEncryptionDisabled
+		}
+
+		intent.AddDoublePuppetValue(content)
+		if err := br.Crypto.Encrypt(roomID, eventType, content); err != nil {
+			return nil, fmt.Errorf("failed to encrypt event: %w", err)
+		}
+		eventType = event.EventEncrypted
+	}
+
+	return intent.SendMessageEvent(roomID, eventType, content)
 }
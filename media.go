@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"mime"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buckket/go-blurhash"
+	"github.com/deltachat/deltachat-rpc-client-go/deltachat"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/crypto/attachment"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	// Images larger than this in either dimension get a thumbnail
+	thumbnailMaxSize = 800
+	thumbnailQuality = 80
+
+	// Blurhashes are calculated from a tiny version of the image, as it only has a few components anyway
+	blurhashImageSize  = 32
+	blurhashComponentX = 4
+	blurhashComponentY = 3
+
+	// Timeout for ffmpeg commands
+	mediaCommandTimeout = 30 * time.Second
+
+	// Images with more pixels aren't decoded, as decoding allocates memory for all of them
+	maxDecodePixels = 50_000_000
+)
+
+var ErrImageTooLarge = errors.New("image is too large to decode")
+
+// mediaInfo builds the info of a media message from the message snapshot and, for images and videos,
+// uploads a thumbnail. The returned map contains extra info fields that the event package doesn't know.
+func (portal *Portal) mediaInfo(msg *deltachat.MsgSnapshot, size int64) (*event.FileInfo, map[string]interface{}) {
+	info := &event.FileInfo{
+		MimeType: msg.FileMime,
+		Size:     int(size),
+		Width:    msg.DimensionsWidth,
+		Height:   msg.DimensionsHeight,
+		Duration: msg.Duration,
+	}
+
+	var img image.Image
+	var err error
+	if strings.HasPrefix(msg.FileMime, "image/") {
+		img, err = decodeImageFile(msg.File)
+	} else if strings.HasPrefix(msg.FileMime, "video/") {
+		img, err = extractVideoFrame(msg.File)
+	} else {
+		return info, nil
+	}
+
+	if err != nil {
+		portal.log.Debug().Err(err).Str("mime", msg.FileMime).Msg("Failed to get image for thumbnail")
+		return info, nil
+	}
+
+	bounds := img.Bounds()
+	if info.Width == 0 || info.Height == 0 {
+		info.Width, info.Height = bounds.Dx(), bounds.Dy()
+	}
+
+	// Videos always need a thumbnail, images only when the original is too large to display as-is
+	if strings.HasPrefix(msg.FileMime, "video/") || bounds.Dx() > thumbnailMaxSize || bounds.Dy() > thumbnailMaxSize {
+		if err = portal.uploadThumbnail(img, info); err != nil {
+			portal.log.Warn().Err(err).Msg("Failed to upload thumbnail")
+		}
+	}
+
+	hash, err := blurhash.Encode(blurhashComponentX, blurhashComponentY, scaleImage(img, blurhashImageSize))
+	if err != nil {
+		portal.log.Warn().Err(err).Msg("Failed to calculate blurhash")
+		return info, nil
+	}
+
+	return info, map[string]interface{}{"xyz.amorgan.blurhash": hash}
+}
+
+func (portal *Portal) uploadThumbnail(img image.Image, info *event.FileInfo) error {
+	thumbnail := scaleImage(img, thumbnailMaxSize)
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, thumbnail, &jpeg.Options{Quality: thumbnailQuality}); err != nil {
+		return err
+	}
+
+	data := buf.Bytes()
+	size := len(data)
+	mxc, file, err := portal.bridge.uploadMedia(portal.bridge.Bot, mautrix.ReqUploadMedia{
+		ContentBytes:  data,
+		ContentLength: int64(size),
+		ContentType:   "image/jpeg",
+	}, portal.bridge.IsRoomEncrypted(portal.MXID))
+	if err != nil {
+		return err
+	}
+
+	if file != nil {
+		info.ThumbnailFile = &event.EncryptedFileInfo{
+			EncryptedFile: *file,
+			URL:           mxc.CUString(),
+		}
+	} else {
+		info.ThumbnailURL = mxc.CUString()
+	}
+
+	bounds := thumbnail.Bounds()
+	info.ThumbnailInfo = &event.FileInfo{
+		MimeType: "image/jpeg",
+		Width:    bounds.Dx(),
+		Height:   bounds.Dy(),
+		Size:     size,
+	}
+
+	return nil
+}
+
+func decodeImageFile(path string) (image.Image, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return decodeImage(file)
+}
+
+// decodeImage decodes an image after checking from its header that it's not too large to decode.
+func decodeImage(r io.ReadSeeker) (image.Image, error) {
+	cfg, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return nil, err
+	} else if int64(cfg.Width)*int64(cfg.Height) > maxDecodePixels {
+		return nil, fmt.Errorf("%w: %dx%d", ErrImageTooLarge, cfg.Width, cfg.Height)
+	}
+
+	if _, err = r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	img, _, err := image.Decode(r)
+	return img, err
+}
+
+// extractVideoFrame uses ffmpeg to get the first frame of a video.
+func extractVideoFrame(path string) (image.Image, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mediaCommandTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "ffmpeg", "-hide_banner", "-loglevel", "error",
+		"-i", path, "-frames:v", "1", "-f", "image2pipe", "-c:v", "png", "-")
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeImage(bytes.NewReader(output))
+}
+
+// scaleImage scales the image down to fit in a square of the given size, keeping the aspect ratio.
+func scaleImage(img image.Image, maxSize int) image.Image {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= maxSize && height <= maxSize {
+		return img
+	}
+
+	if width > height {
+		width, height = maxSize, height*maxSize/width
+	} else {
+		width, height = width*maxSize/height, maxSize
+	}
+	if width < 1 {
+		width = 1
+	} else if height < 1 {
+		height = 1
+	}
+
+	scaled := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.ApproxBiLinear.Scale(scaled, scaled.Bounds(), img, bounds, draw.Src, nil)
+	return scaled
+}
+
+// mediaMessageType maps the Delta Chat view type to a Matrix message type. The MIME type is used for files
+// sent by clients that don't set a specific view type.
+func mediaMessageType(msg *deltachat.MsgSnapshot) event.MessageType {
+	switch msg.ViewType {
+	case deltachat.MSG_TYPE_IMAGE, deltachat.MSG_TYPE_GIF:
+		return event.MsgImage
+	case deltachat.MSG_TYPE_VIDEO:
+		return event.MsgVideo
+	case deltachat.MSG_TYPE_AUDIO, deltachat.MSG_TYPE_VOICE:
+		return event.MsgAudio
+	}
+
+	switch {
+	case strings.HasPrefix(msg.FileMime, "image/"):
+		return event.MsgImage
+	case strings.HasPrefix(msg.FileMime, "video/"):
+		return event.MsgVideo
+	case strings.HasPrefix(msg.FileMime, "audio/"):
+		return event.MsgAudio
+	default:
+		return event.MsgFile
+	}
+}
+
+const (
+	// Number of waveform samples sent with voice messages and the maximum value of each as defined by MSC1767
+	waveformSamples  = 64
+	waveformMaxValue = 1024
+
+	// Sample rate used to decode voice messages for the waveform, which doesn't need more
+	waveformSampleRate = 8000
+)
+
+// addVoiceExtra marks the message as an MSC3245 voice message and adds the MSC1767 audio duration and waveform.
+func (portal *Portal) addVoiceExtra(msg *deltachat.MsgSnapshot, extra map[string]interface{}) {
+	audio := map[string]interface{}{
+		"duration": msg.Duration,
+	}
+
+	waveform, err := audioWaveform(msg.File)
+	if err != nil {
+		portal.log.Warn().Err(err).Msg("Failed to calculate voice message waveform")
+	} else {
+		audio["waveform"] = waveform
+	}
+
+	extra["org.matrix.msc1767.audio"] = audio
+	extra["org.matrix.msc3245.voice"] = map[string]interface{}{}
+}
+
+// audioWaveform decodes the audio file with ffmpeg and returns the peak amplitude of evenly sized chunks,
+// scaled so that the loudest chunk has the maximum value.
+func audioWaveform(path string) ([]int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mediaCommandTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "ffmpeg", "-hide_banner", "-loglevel", "error",
+		"-i", path, "-ac", "1", "-ar", strconv.Itoa(waveformSampleRate), "-f", "s16le", "-")
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+
+	samples := len(output) / 2
+	if samples == 0 {
+		return make([]int, waveformSamples), nil
+	}
+
+	peaks := make([]int, waveformSamples)
+	maxPeak := 1
+	for i := 0; i < samples; i++ {
+		sample := int(int16(binary.LittleEndian.Uint16(output[i*2:])))
+		if sample < 0 {
+			sample = -sample
+		}
+
+		chunk := i * waveformSamples / samples
+		if sample > peaks[chunk] {
+			peaks[chunk] = sample
+		}
+		if sample > maxPeak {
+			maxPeak = sample
+		}
+	}
+
+	for i, peak := range peaks {
+		peaks[i] = peak * waveformMaxValue / maxPeak
+	}
+
+	return peaks, nil
+}
+
+// Audio formats that all Delta Chat clients can play
+var playableVoiceMimeTypes = map[string]bool{
+	"audio/mp4":   true,
+	"audio/x-m4a": true,
+	"audio/aac":   true,
+	"audio/mpeg":  true,
+}
+
+// convertVoiceMessage transcodes a voice message to AAC unless it's already in a format Delta Chat clients play.
+// Matrix clients usually record Ogg Opus, which Delta Chat on iOS can't play. It returns the path of the file
+// to send, which is a new file next to the original with the same name and an .m4a extension if it was
+// converted.
+func convertVoiceMessage(path, mimeType string) (string, error) {
+	if playableVoiceMimeTypes[mimeType] {
+		return path, nil
+	}
+
+	output := strings.TrimSuffix(path, filepath.Ext(path)) + ".m4a"
+	if output == path {
+		output = strings.TrimSuffix(path, filepath.Ext(path)) + "-converted.m4a"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), mediaCommandTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "ffmpeg", "-hide_banner", "-loglevel", "error", "-y",
+		"-i", path, "-vn", "-c:a", "aac", "-b:a", "64k", output)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		_ = os.Remove(output)
+		return "", fmt.Errorf("ffmpeg failed: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	return output, nil
+}
+
+// fileExtension returns the extension of the file name, or one matching the MIME type if the name has none.
+// The core detects the format of some files from their extension.
+func fileExtension(fileName, mimeType string) string {
+	if ext := filepath.Ext(fileName); ext != "" {
+		return ext
+	}
+	if exts, _ := mime.ExtensionsByType(mimeType); len(exts) > 0 {
+		return exts[0]
+	}
+	return ""
+}
+
+// setMediaURL puts the uploaded file in the message content, as an encrypted file if it was encrypted.
+func setMediaURL(content *event.MessageEventContent, mxc id.ContentURI, file *attachment.EncryptedFile) {
+	if file != nil {
+		content.File = &event.EncryptedFileInfo{
+			EncryptedFile: *file,
+			URL:           mxc.CUString(),
+		}
+	} else {
+		content.URL = mxc.CUString()
+	}
+}
+
+// sendMessageEvent sends a message event to the portal room, encrypting it if the room is encrypted.
+func (portal *Portal) sendMessageEvent(intent *appservice.IntentAPI, eventType event.Type, content *event.Content) (*mautrix.RespSendEvent, error) {
+	return portal.bridge.SendMessageEvent(intent, portal.MXID, eventType, content)
+}
@@ -1,16 +1,24 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
 	"strings"
 	"sync"
 
 	"github.com/deltachat/deltachat-rpc-client-go/deltachat"
 	"github.com/rs/zerolog"
+	"go.mau.fi/mautrix-deltachat/config"
 	"go.mau.fi/mautrix-deltachat/database"
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/appservice"
 	"maunium.net/go/mautrix/bridge"
 	"maunium.net/go/mautrix/bridge/bridgeconfig"
+	"maunium.net/go/mautrix/bridge/status"
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 )
@@ -30,8 +38,13 @@ type Portal struct {
 
 	matrixMessages chan portalMatrixMessage
 	dcMessages     chan *deltachat.MsgSnapshot
+	locations      chan *location
 
-	Encrypted bool
+	// Broadcast list recipients as last sent to the room state
+	recipients []BroadcastRecipient
+
+	// Live location shares by contact, only used from the message loop
+	beacons map[deltachat.ContactId]*beacon
 }
 
 func (portal *Portal) Chat() (*deltachat.Chat, error) {
@@ -85,6 +98,10 @@ func (portal *Portal) ReceiveDeltaChatMessage(msg *deltachat.MsgSnapshot) {
 	portal.dcMessages <- msg
 }
 
+func (portal *Portal) ReceiveDeltaChatLocation(loc *location) {
+	portal.locations <- loc
+}
+
 func (portal *Portal) MainIntent() *appservice.IntentAPI {
 	if portal == nil {
 		return portal.bridge.Bot
@@ -150,6 +167,63 @@ func (br *DeltaChatBridge) GetPortalByID(portalID database.PortalID) *Portal {
 	return portal
 }
 
+// GetExistingPortalByID returns the portal of the chat if it's cached or in the database. Unlike GetPortalByID,
+// it never creates a portal, so it's safe to use for events that shouldn't bridge new chats.
+func (br *DeltaChatBridge) GetExistingPortalByID(portalID database.PortalID) *Portal {
+	br.portalsLock.Lock()
+	defer br.portalsLock.Unlock()
+
+	if portal, ok := br.portalsByID[portalID]; ok {
+		return portal
+	}
+
+	dbPortal := br.DB.Portal.Get(portalID)
+	if dbPortal == nil {
+		return nil
+	}
+
+	portal := br.NewPortal(dbPortal)
+	if portal.MXID != "" {
+		br.portalsByMXID[portal.MXID] = portal
+	}
+	br.portalsByID[portalID] = portal
+
+	return portal
+}
+
+func (br *DeltaChatBridge) GetAllPortals() []*Portal {
+	return br.dbPortalsToPortals(br.DB.Portal.GetAll())
+}
+
+func (br *DeltaChatBridge) GetAllPortalsByAccountID(accountID deltachat.AccountId) []*Portal {
+	return br.dbPortalsToPortals(br.DB.Portal.GetAllByAccountID(accountID))
+}
+
+func (br *DeltaChatBridge) dbPortalsToPortals(dbPortals []*database.Portal) []*Portal {
+	br.portalsLock.Lock()
+	defer br.portalsLock.Unlock()
+
+	portals := make([]*Portal, 0, len(dbPortals))
+	for _, dbPortal := range dbPortals {
+		if dbPortal == nil {
+			continue
+		}
+
+		portal, ok := br.portalsByID[dbPortal.ID()]
+		if !ok {
+			portal = br.NewPortal(dbPortal)
+			br.portalsByID[portal.ID()] = portal
+			if portal.MXID != "" {
+				br.portalsByMXID[portal.MXID] = portal
+			}
+		}
+
+		portals = append(portals, portal)
+	}
+
+	return portals
+}
+
 func (br *DeltaChatBridge) NewPortal(dbPortal *database.Portal) *Portal {
 	if dbPortal == nil {
 		return nil
@@ -165,6 +239,7 @@ func (br *DeltaChatBridge) NewPortal(dbPortal *database.Portal) *Portal {
 
 		matrixMessages: make(chan portalMatrixMessage, br.Config.Bridge.PortalMessageBuffer),
 		dcMessages:     make(chan *deltachat.MsgSnapshot, br.Config.Bridge.PortalMessageBuffer),
+		locations:      make(chan *location, br.Config.Bridge.PortalMessageBuffer),
 	}
 
 	go portal.messageLoop()
@@ -179,6 +254,8 @@ func (portal *Portal) messageLoop() {
 			portal.handleMatrixMessages(msg)
 		case msg := <-portal.dcMessages:
 			portal.handleDeltaChatMessage(msg)
+		case loc := <-portal.locations:
+			portal.sendBeaconLocation(loc)
 		}
 	}
 }
@@ -200,6 +277,13 @@ func (portal *Portal) handleMatrixMessage(sender *User, evt *event.Event) {
 		return
 	}
 
+	if portal.ReadOnly {
+		portal.log.Debug().Msg("Dropping message in read-only mailing list")
+		go portal.bridge.SendMessageErrorCheckpoint(evt, status.MsgStepRemote, ErrReadOnlyList, true, 0)
+		portal.sendErrorNotice(evt, "Your message wasn't sent, as this mailing list is read-only.")
+		return
+	}
+
 	user := portal.bridge.GetUserByAccountID(portal.AccountID)
 	if user == nil {
 		portal.log.Error().Msg("Failed to find target account")
@@ -212,6 +296,13 @@ func (portal *Portal) handleMatrixMessage(sender *User, evt *event.Event) {
 		return
 	}
 
+	if evt.Type == event.EventSticker {
+		if err := portal.sendMatrixSticker(content); err != nil {
+			portal.log.Err(err).Msg("Failed to send sticker")
+		}
+		return
+	}
+
 	switch content.MsgType {
 	case event.MsgText, event.MsgEmote, event.MsgNotice:
 		chat, err := portal.Chat()
@@ -226,14 +317,74 @@ func (portal *Portal) handleMatrixMessage(sender *User, evt *event.Event) {
 			return
 		}
 		portal.log.Debug().Str("body", content.Body).Msg("Sent text event!")
-	//case event.MsgAudio, event.MsgFile, event.MsgImage, event.MsgVideo:
+	case event.MsgLocation:
+		if err := portal.sendMatrixLocation(content); err != nil {
+			portal.log.Err(err).Msg("Failed to send location")
+			return
+		}
+	case event.MsgAudio:
+		_, isVoice := evt.Content.Raw["org.matrix.msc3245.voice"]
+		if err := portal.sendMatrixAudio(content, isVoice); err != nil {
+			portal.log.Err(err).Msg("Failed to send audio message")
+			return
+		}
+	//case event.MsgFile, event.MsgImage, event.MsgVideo:
 	default:
 		portal.log.Warn().Str("type", string(content.MsgType)).Msg("Ignored message type from Matrix")
 	}
 }
 
+// sendErrorNotice tells the sender of a Matrix event why it wasn't bridged with a notice replying to it.
+func (portal *Portal) sendErrorNotice(evt *event.Event, message string) {
+	content := &event.MessageEventContent{
+		MsgType: event.MsgNotice,
+		Body:    message,
+	}
+	content.SetReply(evt)
+
+	_, err := portal.sendMessageEvent(portal.bridge.Bot, event.EventMessage, &event.Content{Parsed: content})
+	if err != nil {
+		portal.log.Err(err).Msg("Failed to send error notice")
+	}
+}
+
+// sendMatrixAudio sends a Matrix audio message to Delta Chat. Voice messages are converted to a format
+// every Delta Chat client can play.
+func (portal *Portal) sendMatrixAudio(content *event.MessageEventContent, isVoice bool) error {
+	chat, err := portal.Chat()
+	if err != nil {
+		return err
+	}
+
+	mimeType := ""
+	if content.Info != nil {
+		mimeType = content.Info.MimeType
+	}
+
+	path, err := portal.bridge.DownloadMatrixFileToTempDir(content)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(filepath.Dir(path))
+
+	viewType := deltachat.MSG_TYPE_AUDIO
+	if isVoice {
+		viewType = deltachat.MSG_TYPE_VOICE
+
+		// The converted file is written next to the original, so it's removed with the directory
+		path, err = convertVoiceMessage(path, mimeType)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The core copies the file to its blob directory, so the temporary files can be removed afterwards
+	_, err = chat.SendMsg(deltachat.MsgData{ViewType: viewType, File: path})
+	return err
+}
+
 func (portal *Portal) handleDeltaChatMessage(msg *deltachat.MsgSnapshot) {
-	puppet := portal.bridge.GetPuppetByID(database.PuppetID{AccountID: portal.AccountID, ContactID: msg.FromId, NameOverride: msg.OverrideSenderName})
+	puppet := portal.bridge.GetPuppetByID(database.PuppetID{AccountID: portal.AccountID, ContactID: msg.FromId})
 
 	msgType := event.MsgText
 	intent := puppet.DefaultIntent()
@@ -245,36 +396,307 @@ func (portal *Portal) handleDeltaChatMessage(msg *deltachat.MsgSnapshot) {
 		msgType = event.MsgNotice
 	}
 
-	if msg.File != "" {
-		contentURI, err := portal.bridge.UploadBlobWithName(msg.File, msg.FileName)
-		if err != nil {
+	if portal.ReadOnly && intent != portal.bridge.Bot {
+		if err := portal.allowSender(puppet); err != nil {
+			portal.log.Warn().Err(err).Msg("Failed to raise ghost power level in read-only portal")
+		}
+	}
+
+	// A padlock that doesn't match the chat hints that its encryption changed, but single messages may be
+	// unencrypted in encrypted chats too, so the chat's status is checked instead of following the message
+	if !msg.IsInfo && msg.ShowPadlock != portal.E2EE {
+		portal.updateE2EE()
+	}
+
+	extra := map[string]interface{}{
+		"fi.mau.deltachat.e2ee": msg.ShowPadlock,
+	}
+
+	text := msg.Text
+	if !msg.ShowPadlock && !msg.IsInfo && text != "" {
+		text = portal.bridge.Config.Bridge.UnencryptedMarker + text
+	}
+
+	var textExtra map[string]interface{}
+	if msg.OverrideSenderName != "" && intent != portal.bridge.Bot {
+		profile := portal.perMessageProfile(puppet, msg.OverrideSenderName)
+		extra[perMessageProfileKey] = profile
+
+		// Clients without per-message profile support only see the fallback in the text message
+		textExtra = make(map[string]interface{}, len(extra))
+		for key, value := range extra {
+			textExtra[key] = value
+		}
+		textProfile := *profile
+		if text != "" {
+			textProfile.HasFallback = true
+			text = profile.Displayname + ": " + text
+		}
+		textExtra[perMessageProfileKey] = &textProfile
+	} else {
+		textExtra = extra
+	}
+
+	if msg.ViewType == deltachat.MSG_TYPE_STICKER && msg.File != "" {
+		portal.handleDeltaChatSticker(intent, msg, extra)
+	} else if msg.File != "" {
+		file, err := portal.bridge.UploadBlobWithName(msg.File, msg.FileName, msg.FileMime, portal.bridge.IsRoomEncrypted(portal.MXID))
+		var tooLarge FileTooLargeError
+		if errors.As(err, &tooLarge) {
+			portal.log.Warn().Err(err).Str("file_name", msg.FileName).Msg("Message file is too large to bridge")
+			portal.sendMessageEvent(intent, event.EventMessage, &event.Content{
+				Parsed: &event.MessageEventContent{
+					MsgType: event.MsgNotice,
+					Body:    fmt.Sprintf("Sent a file that couldn't be bridged: %s (%s)", msg.FileName, tooLarge.Error()),
+				},
+				Raw: extra,
+			})
+		} else if err != nil {
 			portal.log.Err(err).Msg("Failed upload message file blob")
 			return
+		} else {
+			mediaType := mediaMessageType(msg)
+			info, extraInfo := portal.mediaInfo(msg, file.Size)
+
+			mediaExtra := make(map[string]interface{}, len(extra)+3)
+			for key, value := range extra {
+				mediaExtra[key] = value
+			}
+			if extraInfo != nil {
+				mediaExtra["info"] = extraInfo
+			}
+			if msg.ViewType == deltachat.MSG_TYPE_VOICE {
+				portal.addVoiceExtra(msg, mediaExtra)
+			}
+
+			content := &event.MessageEventContent{
+				MsgType:  mediaType,
+				FileName: msg.FileName,
+				Body:     msg.FileName,
+				Info:     info,
+			}
+			setMediaURL(content, file.MXC, file.DecryptionInfo)
+
+			portal.sendMessageEvent(intent, event.EventMessage, &event.Content{
+				Parsed: content,
+				Raw:    mediaExtra,
+			})
 		}
+	}
 
-		mediaType := event.MsgFile
-		if strings.HasPrefix(msg.FileMime, "image/") {
-			mediaType = event.MsgImage
-		} else if strings.HasPrefix(msg.FileMime, "video/") {
-			mediaType = event.MsgVideo
+	if msg.HasLocation {
+		if loc, err := portal.getMessageLocation(msg); err != nil {
+			portal.log.Err(err).Msg("Failed to get message location")
+		} else if loc != nil {
+			portal.sendLocation(intent, loc, text, msg.Text, textExtra)
+			return
 		}
+	}
 
-		intent.SendMessageEvent(portal.MXID, event.EventMessage, event.MessageEventContent{
-			MsgType:  mediaType,
-			FileName: msg.FileName,
-			URL:      contentURI.CUString(),
-			Body:     msg.FileName,
-		})
+	// Attachments without a caption don't need a separate text message
+	if msg.Text == "" && msg.File != "" {
+		return
 	}
 
-	intent.SendMessageEvent(portal.MXID, event.EventMessage, event.MessageEventContent{
-		MsgType: msgType,
-		Body:    msg.Text,
+	portal.sendMessageEvent(intent, event.EventMessage, &event.Content{
+		Parsed: &event.MessageEventContent{
+			MsgType: msgType,
+			Body:    text,
+		},
+		Raw: textExtra,
 	})
 }
 
+const perMessageProfileKey = "com.beeper.per_message_profile"
+
+// PerMessageProfile overrides the sender's profile for a single message as proposed in MSC4144.
+type PerMessageProfile struct {
+	ID          string              `json:"id"`
+	Displayname string              `json:"displayname,omitempty"`
+	AvatarURL   id.ContentURIString `json:"avatar_url,omitempty"`
+	HasFallback bool                `json:"has_fallback,omitempty"`
+}
+
+func (portal *Portal) perMessageProfile(puppet *Puppet, override string) *PerMessageProfile {
+	return &PerMessageProfile{
+		ID:          override,
+		Displayname: puppet.OverrideDisplayname(override),
+		AvatarURL:   puppet.AvatarURL.CUString(),
+	}
+}
+
+// updateE2EE checks whether the chat is end-to-end encrypted and updates the topic if that changed.
+func (portal *Portal) updateE2EE() {
+	// Mailing lists are never encrypted and the topic depends on state only known after Update
+	if portal.Type == deltachat.CHAT_TYPE_MAILINGLIST {
+		return
+	}
+
+	chat, err := portal.Chat()
+	if err != nil {
+		portal.log.Err(err).Msg("Failed to get chat from portal")
+		return
+	}
+
+	e2ee, err := portal.isChatE2EE(chat)
+	if err != nil {
+		portal.log.Warn().Err(err).Msg("Failed to get chat encryption info")
+		return
+	} else if e2ee == portal.E2EE {
+		return
+	}
+
+	portal.E2EE = e2ee
+	topic := portal.getTopic()
+	if topic != portal.Topic && portal.MXID != "" {
+		_, err = portal.MainIntent().SetRoomTopic(portal.MXID, topic)
+		if err != nil {
+			portal.log.Warn().Err(err).Msg("Failed to update topic")
+		}
+	}
+	portal.Topic = topic
+	portal.TopicSet = topic != ""
+	portal.UpdateBridgeInfo()
+
+	if err = portal.Upsert(); err != nil {
+		portal.log.Err(err).Msg("Failed to save portal")
+	}
+}
+
+// isChatE2EE returns whether messages sent to the chat are end-to-end encrypted, which is the case for verified
+// chats and for chats where every member has a usable key. The core lists members without one in a
+// "No encryption" section of the chat's encryption info.
+func (portal *Portal) isChatE2EE(chat *deltachat.Chat) (bool, error) {
+	if portal.Protected {
+		return true, nil
+	}
+
+	info, err := chat.EncryptionInfo()
+	if err != nil {
+		return false, err
+	}
+
+	return info != "" && !strings.Contains(info, "No encryption:"), nil
+}
+
+// Delete removes the portal from the database and the bridge caches. The Matrix room is left as-is.
+func (portal *Portal) Delete() {
+	portal.Portal.Delete()
+
+	portal.bridge.portalsLock.Lock()
+	delete(portal.bridge.portalsByID, portal.ID())
+	if portal.MXID != "" {
+		delete(portal.bridge.portalsByMXID, portal.MXID)
+	}
+	portal.bridge.portalsLock.Unlock()
+}
+
+// Cleanup kicks all real users from the Matrix room and makes all ghosts and the main intent leave it.
+func (portal *Portal) Cleanup() {
+	if portal.MXID == "" {
+		return
+	}
+
+	intent := portal.MainIntent()
+	members, err := intent.JoinedMembers(portal.MXID)
+	if err != nil {
+		portal.log.Err(err).Msg("Failed to get portal members for cleanup")
+		return
+	}
+
+	for member := range members.Joined {
+		if member == intent.UserID {
+			continue
+		}
+
+		if portal.bridge.IsGhost(member) || member == portal.bridge.Bot.UserID {
+			_, err = portal.bridge.AS.Intent(member).LeaveRoom(portal.MXID)
+		} else {
+			_, err = intent.KickUser(portal.MXID, &mautrix.ReqKickUser{UserID: member, Reason: "Deleting portal"})
+		}
+
+		if err != nil {
+			portal.log.Warn().Err(err).Str("user_id", member.String()).Msg("Failed to remove member from portal")
+		}
+	}
+
+	_, err = intent.LeaveRoom(portal.MXID)
+	if err != nil {
+		portal.log.Warn().Err(err).Msg("Failed to leave portal")
+	}
+}
+
+// Values of the fi.mau.deltachat.encryption field in the bridge info.
+const (
+	encryptionVerified    = "verified"
+	encryptionEncrypted   = "encrypted"
+	encryptionUnencrypted = "unencrypted"
+)
+
+func (portal *Portal) getBridgeInfoStateKey() string {
+	return fmt.Sprintf("fi.mau.deltachat://deltachat/%d/%d", portal.AccountID, portal.ChatID)
+}
+
+func (portal *Portal) getEncryptionStatus() string {
+	if portal.Protected {
+		return encryptionVerified
+	} else if portal.E2EE {
+		return encryptionEncrypted
+	}
+	return encryptionUnencrypted
+}
+
+func (portal *Portal) getBridgeInfo() (string, *event.Content) {
+	bridgeInfo := event.BridgeEventContent{
+		BridgeBot: portal.bridge.Bot.UserID,
+		Creator:   portal.MainIntent().UserID,
+		Protocol: event.BridgeInfoSection{
+			ID:          "deltachat",
+			DisplayName: "Delta Chat",
+			ExternalURL: "https://delta.chat/",
+		},
+		Channel: event.BridgeInfoSection{
+			ID:          strconv.FormatUint(uint64(portal.ChatID), 10),
+			DisplayName: portal.Name,
+			AvatarURL:   portal.AvatarURL.CUString(),
+		},
+	}
+
+	if user := portal.bridge.GetUserByAccountID(portal.AccountID); user != nil {
+		if addr, err := user.GetConfig("configured_addr"); err != nil {
+			portal.log.Warn().Err(err).Msg("Failed to get account address for bridge info")
+		} else {
+			bridgeInfo.Network = &event.BridgeInfoSection{
+				ID:          addr,
+				DisplayName: addr,
+			}
+		}
+	}
+
+	return portal.getBridgeInfoStateKey(), &event.Content{
+		Parsed: &bridgeInfo,
+		Raw: map[string]interface{}{
+			"fi.mau.deltachat.encryption": portal.getEncryptionStatus(),
+		},
+	}
+}
+
 func (portal *Portal) UpdateBridgeInfo() {
-	portal.log.Debug().Msg("UpdateBridgeInfo() stub")
+	if len(portal.MXID) == 0 {
+		portal.log.Debug().Msg("Not updating bridge info: no Matrix room created")
+		return
+	}
+	portal.log.Debug().Msg("Updating bridge info...")
+	stateKey, content := portal.getBridgeInfo()
+	_, err := portal.MainIntent().SendStateEvent(portal.MXID, event.StateBridge, stateKey, content)
+	if err != nil {
+		portal.log.Warn().Err(err).Msg("Failed to update m.bridge")
+	}
+	// TODO remove this once https://github.com/matrix-org/matrix-doc/pull/2346 is in spec
+	_, err = portal.MainIntent().SendStateEvent(portal.MXID, event.StateHalfShotBridge, stateKey, content)
+	if err != nil {
+		portal.log.Warn().Err(err).Msg("Failed to update uk.half-shot.bridge")
+	}
 }
 
 func (portal *Portal) ensureUserInvited(user *User) bool {
@@ -290,6 +712,52 @@ func (portal *Portal) GetEncryptionEventContent() (evt *event.EncryptionEventCon
 	return
 }
 
+func (portal *Portal) shouldSetDMRoomMetadata() bool {
+	return portal.bridge.Config.Bridge.PrivateChatPortalMeta || portal.Encrypted
+}
+
+func chatTypeName(chatType deltachat.ChatType) string {
+	switch chatType {
+	case deltachat.CHAT_TYPE_SINGLE:
+		return "single"
+	case deltachat.CHAT_TYPE_GROUP:
+		return "group"
+	case deltachat.CHAT_TYPE_MAILINGLIST:
+		return "mailinglist"
+	case deltachat.CHAT_TYPE_BROADCAST:
+		return "broadcast"
+	default:
+		return ""
+	}
+}
+
+// getTopic returns the topic describing the chat's encryption, as Delta Chat chats have no topic of their own.
+func (portal *Portal) getTopic() string {
+	if portal.Type == deltachat.CHAT_TYPE_MAILINGLIST {
+		topic := "Mailing list"
+		if portal.ListAddress != "" {
+			topic += " " + portal.ListAddress
+		}
+		if portal.ReadOnly {
+			topic += " (read-only)"
+		}
+		return topic
+	} else if portal.Type == deltachat.CHAT_TYPE_BROADCAST {
+		return "Broadcast list: recipients get messages in their private chat with you and can't see each other. " +
+			portal.getEncryptionTopic()
+	}
+	return portal.getEncryptionTopic()
+}
+
+func (portal *Portal) getEncryptionTopic() string {
+	if portal.Protected {
+		return "Verified chat: all members are verified and messages are always end-to-end encrypted."
+	} else if portal.E2EE {
+		return "Encrypted chat: messages are end-to-end encrypted, but members are not verified."
+	}
+	return "Unencrypted chat: messages may be sent in the clear."
+}
+
 func (portal *Portal) Update() error {
 	chat, err := portal.Chat()
 	if err != nil {
@@ -326,20 +794,54 @@ func (portal *Portal) Update() error {
 
 	portal.Type = snap.ChatType
 
-	nameChanged := false
-	if portal.Type == deltachat.CHAT_TYPE_SINGLE {
-		nameChanged = portal.Name != ""
-		portal.Name = ""
-		portal.NameSet = false
-	} else {
-		nameChanged = portal.Name != snap.Name
-		portal.Name = snap.Name
-		portal.NameSet = true
+	// DMs only get a name and avatar if enabled, otherwise clients show the other member's
+	setMeta := !portal.IsPrivateChat() || portal.shouldSetDMRoomMetadata()
+
+	name := ""
+	if setMeta {
+		params := config.ChannelNameParams{
+			Name:               snap.Name,
+			Type:               chatTypeName(snap.ChatType),
+			MailingListAddress: snap.MailingListAddress,
+			MemberCount:        countMembers(snap.ContactIds),
+		}
+		if portal.IsPrivateChat() && len(snap.ContactIds) > 0 {
+			puppet := portal.bridge.GetPuppetByID(database.PuppetID{AccountID: portal.AccountID, ContactID: snap.ContactIds[0]})
+			params.Name = puppet.Name
+		}
+		name = portal.bridge.Config.Bridge.FormatChannelName(params)
 	}
 
-	avatarChanged := portal.Avatar != snap.ProfileImage
+	portal.PlainName = snap.Name
+	nameChanged := portal.Name != name
+	portal.Name = name
+	portal.NameSet = name != ""
+
+	portal.Protected = snap.IsProtected
+	portal.ListAddress = snap.MailingListAddress
+	readOnly := isReadOnlyList(snap)
+	readOnlyChanged := portal.ReadOnly != readOnly
+	portal.ReadOnly = readOnly
+
+	if portal.Type != deltachat.CHAT_TYPE_MAILINGLIST {
+		if portal.E2EE, err = portal.isChatE2EE(chat); err != nil {
+			return err
+		}
+	}
+
+	topic := portal.getTopic()
+	topicChanged := portal.Topic != topic
+	portal.Topic = topic
+	portal.TopicSet = topic != ""
+
+	avatar := ""
+	if setMeta {
+		avatar = snap.ProfileImage
+	}
+
+	avatarChanged := portal.Avatar != avatar
 	if avatarChanged {
-		portal.Avatar = snap.ProfileImage
+		portal.Avatar = avatar
 		portal.AvatarSet = portal.Avatar != ""
 
 		if portal.AvatarSet {
@@ -360,10 +862,16 @@ func (portal *Portal) Update() error {
 		}
 	}
 
-	// FIXME configurable
-	for _, contactID := range snap.ContactIds {
-		puppet := portal.bridge.GetPuppetByID(database.PuppetID{AccountID: *user.AccountID, ContactID: contactID})
-		puppet.DefaultIntent().EnsureJoined(portal.MXID)
+	// Mailing list members are unknown, senders join when they send their first message. Broadcast
+	// recipients can't see each other, so they're only listed in the room state.
+	if portal.Type == deltachat.CHAT_TYPE_BROADCAST {
+		portal.updateBroadcastRecipients(user, snap.Contacts)
+	} else if portal.Type != deltachat.CHAT_TYPE_MAILINGLIST {
+		// FIXME configurable
+		for _, contactID := range snap.ContactIds {
+			puppet := portal.bridge.GetPuppetByID(database.PuppetID{AccountID: *user.AccountID, ContactID: contactID})
+			puppet.DefaultIntent().EnsureJoined(portal.MXID)
+		}
 	}
 
 	portal.ensureUserInvited(user)
@@ -373,16 +881,206 @@ func (portal *Portal) Update() error {
 	}
 
 	if nameChanged {
-		_, _ = user.bridge.Bot.SetRoomName(portal.MXID, portal.Name)
+		_, _ = portal.MainIntent().SetRoomName(portal.MXID, portal.Name)
+	}
+
+	if topicChanged {
+		_, _ = portal.MainIntent().SetRoomTopic(portal.MXID, portal.Topic)
 	}
 
 	if avatarChanged {
-		_, _ = user.bridge.Bot.SetRoomAvatar(portal.MXID, portal.AvatarURL)
+		_, _ = portal.MainIntent().SetRoomAvatar(portal.MXID, portal.AvatarURL)
+	}
+
+	if readOnlyChanged {
+		portal.updateReadOnly(user)
+	}
+
+	if nameChanged || topicChanged || avatarChanged {
+		portal.UpdateBridgeInfo()
 	}
 
 	return portal.Upsert()
 }
 
+// countMembers returns the number of chat members other than the user.
+func countMembers(contactIDs []deltachat.ContactId) int {
+	count := 0
+	for _, contactID := range contactIDs {
+		if contactID != deltachat.CONTACT_SELF {
+			count++
+		}
+	}
+	return count
+}
+
+// BroadcastRecipient is an entry of the broadcast recipients state event.
+type BroadcastRecipient struct {
+	Address string    `json:"address"`
+	Name    string    `json:"name,omitempty"`
+	UserID  id.UserID `json:"user_id"`
+}
+
+type BroadcastRecipientsEventContent struct {
+	Recipients []BroadcastRecipient `json:"recipients"`
+}
+
+var StateBroadcastRecipients = event.Type{Type: "fi.mau.deltachat.broadcast_recipients", Class: event.StateEventType}
+
+// updateBroadcastRecipients puts the recipients of a broadcast list in the room state if they changed.
+func (portal *Portal) updateBroadcastRecipients(user *User, contacts []*deltachat.ContactSnapshot) {
+	recipients := make([]BroadcastRecipient, 0, len(contacts))
+	for _, contact := range contacts {
+		if contact.Id == deltachat.CONTACT_SELF {
+			continue
+		}
+		recipients = append(recipients, BroadcastRecipient{
+			Address: contact.Address,
+			Name:    contact.DisplayName,
+			UserID:  portal.bridge.FormatPuppetMXID(user.GetPuppetID(contact.Id)),
+		})
+	}
+
+	if portal.recipients != nil && reflect.DeepEqual(portal.recipients, recipients) {
+		return
+	}
+
+	content := &BroadcastRecipientsEventContent{Recipients: recipients}
+	if _, err := portal.MainIntent().SendStateEvent(portal.MXID, StateBroadcastRecipients, "", content); err != nil {
+		portal.log.Err(err).Msg("Failed to update broadcast recipients")
+		return
+	}
+	portal.recipients = recipients
+}
+
+var ErrNotBroadcast = errors.New("not a broadcast list")
+
+// BroadcastRecipients returns the current recipients of the broadcast list from the core.
+func (portal *Portal) BroadcastRecipients() ([]*deltachat.ContactSnapshot, error) {
+	chat, err := portal.broadcastChat()
+	if err != nil {
+		return nil, err
+	}
+
+	snap, err := chat.FullSnapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	recipients := make([]*deltachat.ContactSnapshot, 0, len(snap.Contacts))
+	for _, contact := range snap.Contacts {
+		if contact.Id != deltachat.CONTACT_SELF {
+			recipients = append(recipients, contact)
+		}
+	}
+
+	return recipients, nil
+}
+
+// AddBroadcastRecipient adds the address to the broadcast list, creating a contact for it if needed.
+func (portal *Portal) AddBroadcastRecipient(addr string) error {
+	chat, err := portal.broadcastChat()
+	if err != nil {
+		return err
+	}
+
+	contact, err := chat.Account.CreateContact(addr, "")
+	if err != nil {
+		return err
+	}
+
+	return chat.AddContact(contact)
+}
+
+// RemoveBroadcastRecipient removes the address from the broadcast list.
+func (portal *Portal) RemoveBroadcastRecipient(addr string) error {
+	chat, err := portal.broadcastChat()
+	if err != nil {
+		return err
+	}
+
+	contact, err := chat.Account.GetContactByAddr(addr)
+	if err != nil {
+		return err
+	} else if contact == nil {
+		return fmt.Errorf("no contact with address %s", addr)
+	}
+
+	return chat.RemoveContact(contact)
+}
+
+func (portal *Portal) broadcastChat() (*deltachat.Chat, error) {
+	if portal.Type != deltachat.CHAT_TYPE_BROADCAST {
+		return nil, ErrNotBroadcast
+	}
+	return portal.Chat()
+}
+
+var ErrReadOnlyList = errors.New("mailing list is read-only")
+
+// isReadOnlyList returns whether the chat is a mailing list that can't be replied to.
+func isReadOnlyList(snap *deltachat.FullChatSnapshot) bool {
+	return snap.ChatType == deltachat.CHAT_TYPE_MAILINGLIST && !snap.CanSend
+}
+
+// applyReadOnly changes the power levels so that only the bridge can send messages if the portal is read-only.
+// Ghosts are raised one by one when they send their first message, see allowSender.
+func (portal *Portal) applyReadOnly(levels *event.PowerLevelsEventContent, user *User) {
+	if portal.ReadOnly {
+		levels.EventsDefault = 50
+	} else {
+		levels.EventsDefault = 0
+	}
+	levels.UsersDefault = 0
+	levels.SetUserLevel(user.MXID, 0)
+	levels.SetUserLevel(portal.MainIntent().UserID, 100)
+}
+
+// allowSender raises the power level of the ghost to the one required for messages in a read-only portal.
+func (portal *Portal) allowSender(puppet *Puppet) error {
+	return portal.ensureUserLevel(puppet.MXID, func(levels *event.PowerLevelsEventContent) int {
+		return levels.GetEventLevel(event.EventMessage)
+	})
+}
+
+// ensureUserLevel raises the power level of a user to the level returned by required, if it's lower. Power
+// levels are raised for single users rather than lowering the required levels, which would apply to everyone.
+func (portal *Portal) ensureUserLevel(userID id.UserID, required func(*event.PowerLevelsEventContent) int) error {
+	intent := portal.MainIntent()
+	levels, err := intent.PowerLevels(portal.MXID)
+	if err != nil {
+		return err
+	}
+
+	level := required(levels)
+	if levels.GetUserLevel(userID) >= level {
+		return nil
+	}
+
+	levels.SetUserLevel(userID, level)
+	_, err = intent.SetPowerLevels(portal.MXID, levels)
+	return err
+}
+
+func (portal *Portal) updateReadOnly(user *User) {
+	intent := portal.MainIntent()
+	levels, err := intent.PowerLevels(portal.MXID)
+	if err != nil {
+		portal.log.Err(err).Msg("Failed to get power levels")
+		return
+	}
+
+	usersDefault, eventsDefault := levels.UsersDefault, levels.EventsDefault
+	portal.applyReadOnly(levels, user)
+	if levels.UsersDefault == usersDefault && levels.EventsDefault == eventsDefault {
+		return
+	}
+
+	if _, err = intent.SetPowerLevels(portal.MXID, levels); err != nil {
+		portal.log.Err(err).Msg("Failed to update power levels")
+	}
+}
+
 func (portal *Portal) createMatrixRoom(user *User) error {
 	portal.log.Info().Msg("Creating Matrix room for chat")
 
@@ -391,20 +1089,17 @@ func (portal *Portal) createMatrixRoom(user *User) error {
 		return err
 	}
 
-	initialState := []*event.Event{}
-	/*
-		bridgeInfoStateKey, bridgeInfo := portal.getBridgeInfo()
-		initialState := []*event.Event{{
-			Type:     event.StateBridge,
-			Content:  event.Content{Parsed: bridgeInfo},
-			StateKey: &bridgeInfoStateKey,
-		}, {
-			// TODO remove this once https://github.com/matrix-org/matrix-doc/pull/2346 is in spec
-			Type:     event.StateHalfShotBridge,
-			Content:  event.Content{Parsed: bridgeInfo},
-			StateKey: &bridgeInfoStateKey,
-		}}
-	*/
+	bridgeInfoStateKey, bridgeInfo := portal.getBridgeInfo()
+	initialState := []*event.Event{{
+		Type:     event.StateBridge,
+		Content:  *bridgeInfo,
+		StateKey: &bridgeInfoStateKey,
+	}, {
+		// TODO remove this once https://github.com/matrix-org/matrix-doc/pull/2346 is in spec
+		Type:     event.StateHalfShotBridge,
+		Content:  *bridgeInfo,
+		StateKey: &bridgeInfoStateKey,
+	}}
 
 	if !portal.AvatarURL.IsEmpty() {
 		initialState = append(initialState, &event.Event{
@@ -436,15 +1131,22 @@ func (portal *Portal) createMatrixRoom(user *User) error {
 		}
 	}
 
+	var powerLevels *event.PowerLevelsEventContent
+	if portal.ReadOnly {
+		powerLevels = &event.PowerLevelsEventContent{}
+		portal.applyReadOnly(powerLevels, user)
+	}
+
 	resp, err := intent.CreateRoom(&mautrix.ReqCreateRoom{
-		Visibility:      "private",
-		Name:            portal.Name,
-		Topic:           portal.Topic,
-		Invite:          invite,
-		Preset:          "private_chat",
-		IsDirect:        portal.IsPrivateChat(),
-		InitialState:    initialState,
-		CreationContent: creationContent,
+		Visibility:         "private",
+		Name:               portal.Name,
+		Topic:              portal.Topic,
+		Invite:             invite,
+		Preset:             "private_chat",
+		IsDirect:           portal.IsPrivateChat(),
+		InitialState:       initialState,
+		CreationContent:    creationContent,
+		PowerLevelOverride: powerLevels,
 	})
 	if err != nil {
 		portal.log.Err(err).Msg("Failed to create room")
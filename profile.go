@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+var ErrNotImage = errors.New("not an image")
+
+// SetAvatar makes the image the avatar of the Delta Chat account. The core copies and resizes the
+// image, so the data isn't needed afterwards.
+func (user *User) SetAvatar(data []byte) error {
+	mimeType := http.DetectContentType(data)
+	if !strings.HasPrefix(mimeType, "image/") {
+		return ErrNotImage
+	}
+
+	// The core detects the image format from the file extension
+	pattern := "mautrix-deltachat-avatar-*"
+	if exts, _ := mime.ExtensionsByType(mimeType); len(exts) > 0 {
+		pattern += exts[0]
+	}
+
+	file, err := os.CreateTemp("", pattern)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	_, err = file.Write(data)
+	_ = file.Close()
+	if err != nil {
+		return err
+	}
+
+	acct, err := user.Account()
+	if err != nil {
+		return err
+	}
+
+	return acct.SetAvatar(file.Name())
+}
+
+// ClearAvatar removes the avatar of the Delta Chat account.
+func (user *User) ClearAvatar() error {
+	acct, err := user.Account()
+	if err != nil {
+		return err
+	}
+
+	return acct.Manager.Rpc.Call("set_config", acct.Id, "selfavatar", nil)
+}
+
+// syncMatrixProfile copies the Matrix user's displayname and avatar to the Delta Chat account
+// if profile syncing is enabled.
+func (user *User) syncMatrixProfile() {
+	if !user.bridge.Config.Bridge.SyncMatrixProfile {
+		return
+	}
+
+	profile, err := user.bridge.Bot.GetProfile(user.MXID)
+	if err != nil {
+		user.log.Warn().Err(err).Msg("Failed to get Matrix profile")
+		return
+	}
+
+	user.updateProfile(profile.DisplayName, profile.AvatarURL)
+}
+
+// updateProfile copies the displayname and avatar to the Delta Chat account. Empty displaynames are skipped,
+// as Matrix clients fall back to the user ID, while an empty displayname in Delta Chat hides the name. The last
+// synced avatar is saved, so it's only uploaded again when it changes.
+func (user *User) updateProfile(displayname string, avatarURL id.ContentURI) {
+	if displayname != "" {
+		if current, err := user.GetConfig("displayname"); err != nil {
+			user.log.Warn().Err(err).Msg("Failed to get displayname")
+		} else if current != displayname {
+			if err = user.SetConfig("displayname", displayname); err != nil {
+				user.log.Warn().Err(err).Msg("Failed to update displayname")
+			}
+		}
+	}
+
+	if avatarURL == user.SyncedAvatarURL {
+		return
+	}
+
+	if avatarURL.IsEmpty() {
+		if err := user.ClearAvatar(); err != nil {
+			user.log.Warn().Err(err).Msg("Failed to remove avatar")
+			return
+		}
+	} else {
+		data, err := user.bridge.Bot.DownloadBytes(avatarURL)
+		if err != nil {
+			user.log.Warn().Err(err).Msg("Failed to download Matrix avatar")
+			return
+		}
+
+		if err = user.SetAvatar(data); err != nil {
+			user.log.Warn().Err(err).Msg("Failed to update avatar")
+			return
+		}
+	}
+
+	user.SyncedAvatarURL = avatarURL
+	user.Update()
+}
+
+// handleMemberEvent syncs profile changes of logged in users. Profile changes are sent to every room the
+// user is in, so only the ones in the management room are used.
+func (br *DeltaChatBridge) handleMemberEvent(evt *event.Event) {
+	if !br.Config.Bridge.SyncMatrixProfile || evt.StateKey == nil || *evt.StateKey != evt.Sender.String() {
+		return
+	}
+
+	user := br.GetUserByMXID(evt.Sender)
+	if user == nil || user.GetManagementRoomID() != evt.RoomID || !user.IsLoggedIn() {
+		return
+	}
+
+	content := evt.Content.AsMember()
+	if content.Membership != event.MembershipJoin {
+		return
+	}
+
+	avatarURL, _ := content.AvatarURL.Parse()
+	go user.updateProfile(content.Displayname, avatarURL)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+type ProvisioningAPI struct {
+	bridge *DeltaChatBridge
+	log    zerolog.Logger
+}
+
+func newProvisioningAPI(br *DeltaChatBridge) *ProvisioningAPI {
+	p := &ProvisioningAPI{
+		bridge: br,
+		log:    br.ZLog.With().Str("component", "provisioning").Logger(),
+	}
+
+	prefix := br.Config.Bridge.Provisioning.Prefix
+
+	p.log.Debug().Str("prefix", prefix).Msg("Enabling provisioning API")
+
+	r := br.AS.Router.PathPrefix(prefix).Subrouter()
+	r.Use(p.authMiddleware)
+
+	r.HandleFunc("/v1/logout", p.logout).Methods(http.MethodPost)
+
+	return p
+}
+
+func jsonResponse(w http.ResponseWriter, status int, response interface{}) {
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+// Response structs
+type Response struct {
+	Success bool   `json:"success"`
+	Status  string `json:"status"`
+}
+
+type Error struct {
+	Success bool   `json:"success"`
+	Error   string `json:"error"`
+	ErrCode string `json:"errcode"`
+}
+
+type provisioningContextKey int
+
+const (
+	provisioningUserKey provisioningContextKey = iota
+)
+
+func (p *ProvisioningAPI) authMiddleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		auth = strings.TrimPrefix(auth, "Bearer ")
+
+		if auth != p.bridge.Config.Bridge.Provisioning.SharedSecret {
+			p.log.Info().Msg("Authentication token does not match shared secret")
+			jsonResponse(w, http.StatusForbidden, &mautrix.RespError{
+				Err:     "Authentication token does not match shared secret",
+				ErrCode: mautrix.MForbidden.ErrCode,
+			})
+			return
+		}
+
+		userID := id.UserID(r.URL.Query().Get("user_id"))
+		user := p.bridge.GetUserByMXID(userID)
+		if user == nil {
+			jsonResponse(w, http.StatusBadRequest, &mautrix.RespError{
+				Err:     "Invalid or missing user_id",
+				ErrCode: mautrix.MInvalidParam.ErrCode,
+			})
+			return
+		}
+
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), provisioningUserKey, user)))
+	})
+}
+
+func (p *ProvisioningAPI) logout(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(provisioningUserKey).(*User)
+
+	err := user.Logout()
+	if err == ErrNotLoggedIn {
+		jsonResponse(w, http.StatusNotFound, Error{
+			Error:   "You're not logged in",
+			ErrCode: "not logged in",
+		})
+		return
+	} else if err != nil {
+		user.log.Err(err).Msg("Failed to log out via provisioning API")
+		jsonResponse(w, http.StatusInternalServerError, Error{
+			Error:   err.Error(),
+			ErrCode: "logout failed",
+		})
+		return
+	}
+
+	jsonResponse(w, http.StatusOK, Response{true, "Logged out successfully."})
+}
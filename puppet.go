@@ -6,6 +6,7 @@ import (
 
 	"github.com/deltachat/deltachat-rpc-client-go/deltachat"
 	"github.com/rs/zerolog"
+	"go.mau.fi/mautrix-deltachat/config"
 	"go.mau.fi/mautrix-deltachat/database"
 	"maunium.net/go/mautrix/appservice"
 	"maunium.net/go/mautrix/id"
@@ -18,6 +19,9 @@ type Puppet struct {
 	log    zerolog.Logger
 
 	MXID id.UserID
+
+	// Template variables of the last update, used to format per-message sender names
+	displaynameParams config.DisplaynameParams
 }
 
 func (puppet *Puppet) GetMXID() id.UserID {
@@ -38,7 +42,7 @@ var userIDRegex *regexp.Regexp
 
 func (br *DeltaChatBridge) ParsePuppetMXID(mxid id.UserID) (_ database.PuppetID, _ bool) {
 	if userIDRegex == nil {
-		userIDRegex = regexp.MustCompile(br.Config.Bridge.FormatUsername("([0-9]+)_([0-9]+)(_(.+))?"))
+		userIDRegex = regexp.MustCompile("^" + br.Config.Bridge.FormatUsername("([0-9]+)_([0-9]+)") + "$")
 	}
 
 	localpart, homeserver, err := mxid.ParseAndDecode()
@@ -61,15 +65,9 @@ func (br *DeltaChatBridge) ParsePuppetMXID(mxid id.UserID) (_ database.PuppetID,
 		return
 	}
 
-	var nameOverride string
-	if len(match) > 4 {
-		nameOverride = match[4]
-	}
-
 	return database.PuppetID{
-		AccountID:    deltachat.AccountId(accountID),
-		ContactID:    deltachat.ContactId(contactID),
-		NameOverride: nameOverride,
+		AccountID: deltachat.AccountId(accountID),
+		ContactID: deltachat.ContactId(contactID),
 	}, true
 }
 
@@ -93,7 +91,6 @@ func (br *DeltaChatBridge) GetPuppetByID(puppetID database.PuppetID) *Puppet {
 			dbPuppet = br.DB.Puppet.New()
 			dbPuppet.AccountID = puppetID.AccountID
 			dbPuppet.ContactID = puppetID.ContactID
-			dbPuppet.NameOverride = puppetID.NameOverride
 		}
 
 		puppet = br.NewPuppet(dbPuppet)
@@ -104,6 +101,15 @@ func (br *DeltaChatBridge) GetPuppetByID(puppetID database.PuppetID) *Puppet {
 	return puppet
 }
 
+// Delete removes the puppet from the database and the bridge cache.
+func (puppet *Puppet) Delete() {
+	puppet.Puppet.Delete()
+
+	puppet.bridge.puppetsLock.Lock()
+	delete(puppet.bridge.puppets, puppet.ID())
+	puppet.bridge.puppetsLock.Unlock()
+}
+
 func (br *DeltaChatBridge) FormatPuppetMXID(puppetID database.PuppetID) id.UserID {
 	return id.NewEncodedUserID(
 		br.Config.Bridge.FormatUsername(puppetID.String()),
@@ -111,6 +117,37 @@ func (br *DeltaChatBridge) FormatPuppetMXID(puppetID database.PuppetID) id.UserI
 	)
 }
 
+// cleanupLegacyOverridePuppets makes the ghosts that older versions created for sender name overrides leave
+// their rooms, as overrides are bridged as per-message profiles of the contact's ghost now.
+func (br *DeltaChatBridge) cleanupLegacyOverridePuppets() {
+	for _, legacy := range br.DB.Puppet.GetAllLegacyOverrides() {
+		mxid := id.NewEncodedUserID(br.Config.Bridge.FormatUsername(legacy.String()), br.Config.Homeserver.Domain)
+		log := br.ZLog.With().Str("user_id", mxid.String()).Logger()
+		intent := br.AS.Intent(mxid)
+
+		resp, err := intent.JoinedRooms()
+		if err != nil {
+			log.Warn().Err(err).Msg("Failed to get rooms of legacy sender name override ghost")
+			continue
+		}
+
+		left := true
+		for _, roomID := range resp.JoinedRooms {
+			if _, err = intent.LeaveRoom(roomID); err != nil {
+				log.Warn().Err(err).Str("room_id", roomID.String()).Msg("Failed to leave room with legacy sender name override ghost")
+				left = false
+			}
+		}
+
+		// Ghosts that couldn't leave all rooms are retried on the next start
+		if !left {
+			continue
+		} else if err = br.DB.Puppet.DeleteLegacyOverride(legacy); err != nil {
+			log.Err(err).Msg("Failed to delete legacy sender name override ghost")
+		}
+	}
+}
+
 func (puppet *Puppet) DefaultIntent() *appservice.IntentAPI {
 	return puppet.bridge.AS.Intent(puppet.MXID)
 }
@@ -125,6 +162,12 @@ func (puppet *Puppet) CustomIntent() *appservice.IntentAPI {
 	return nil
 }
 
+// contactSnapshot extends the client library's snapshot with fields only sent by newer cores.
+type contactSnapshot struct {
+	deltachat.ContactSnapshot
+	IsBot bool
+}
+
 func (puppet *Puppet) Update() error {
 	user := puppet.bridge.GetUserByAccountID(puppet.AccountID)
 	if user == nil {
@@ -141,22 +184,29 @@ func (puppet *Puppet) Update() error {
 		Id:      puppet.ContactID,
 	}
 
-	snap, err := contact.Snapshot()
+	var snap contactSnapshot
+	err = acct.Manager.Rpc.CallResult(&snap, "get_contact", acct.Id, contact.Id)
 	if err != nil {
 		return err
 	}
 
 	intent := puppet.DefaultIntent()
 
-	// quick hack to force name
-	if puppet.NameOverride != "" {
-		snap.NameAndAddr = "~" + puppet.NameOverride
+	puppet.displaynameParams = config.DisplaynameParams{
+		ID:          snap.Id,
+		Address:     snap.Address,
+		DisplayName: snap.DisplayName,
+		AuthName:    snap.AuthName,
+		Name:        snap.Name,
+		IsVerified:  snap.IsVerified,
+		IsBot:       snap.IsBot,
 	}
+	name := puppet.bridge.Config.Bridge.FormatDisplayname(puppet.displaynameParams)
 
-	updateName := puppet.Name != snap.NameAndAddr
+	updateName := puppet.Name != name
 
 	if updateName {
-		puppet.Name = snap.NameAndAddr
+		puppet.Name = name
 		puppet.NameSet = true
 
 		err = intent.SetDisplayName(puppet.Name)
@@ -186,6 +236,15 @@ func (puppet *Puppet) Update() error {
 	return puppet.Upsert()
 }
 
+// OverrideDisplayname formats the name to show for a message with a sender name override, which bots and
+// mailing lists use to send messages on behalf of others.
+func (puppet *Puppet) OverrideDisplayname(override string) string {
+	params := puppet.displaynameParams
+	params.NameOverride = override
+	params.DisplayName = "~" + override
+	return puppet.bridge.Config.Bridge.FormatDisplayname(params)
+}
+
 func (puppet *Puppet) SwitchCustomMXID(accessToken string, mxid id.UserID) error {
 	return nil
 }
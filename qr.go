@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+
+	"github.com/deltachat/deltachat-rpc-client-go/deltachat"
+	"github.com/makiuchi-d/gozxing"
+	"github.com/makiuchi-d/gozxing/qrcode"
+	goqrcode "github.com/skip2/go-qrcode"
+)
+
+var (
+	ErrNoQRCode    = errors.New("no QR code found in image")
+	ErrNotLoginQR  = errors.New("not a DCACCOUNT or DCLOGIN code")
+	ErrNotBackupQR = errors.New("not a DCBACKUP code")
+	ErrNotInviteQR = errors.New("not a contact or group invite code")
+)
+
+// Kinds of QR codes as returned by the core's check_qr.
+const (
+	QrAccount          = "account"
+	QrLogin            = "login"
+	QrBackup           = "backup"
+	QrAskVerifyContact = "askVerifyContact"
+	QrAskVerifyGroup   = "askVerifyGroup"
+)
+
+// Qr is the parsed content of a Delta Chat QR code.
+type Qr struct {
+	Kind    string
+	Domain  string
+	Address string
+	Text    string
+}
+
+func checkQR(acct *deltachat.Account, text string) (*Qr, error) {
+	var qr Qr
+	err := acct.Manager.Rpc.CallResult(&qr, "check_qr", acct.Id, text)
+	if err != nil {
+		return nil, err
+	}
+	return &qr, nil
+}
+
+func setConfigFromQR(acct *deltachat.Account, text string) error {
+	return acct.Manager.Rpc.Call("set_config_from_qr", acct.Id, text)
+}
+
+func decodeQRImage(data []byte) (string, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+
+	bmp, err := gozxing.NewBinaryBitmapFromImage(img)
+	if err != nil {
+		return "", err
+	}
+
+	result, err := qrcode.NewQRCodeReader().Decode(bmp, nil)
+	if err != nil {
+		return "", ErrNoQRCode
+	}
+
+	return result.GetText(), nil
+}
+
+// qrImageSize is the width and height of generated QR code images in pixels.
+const qrImageSize = 512
+
+func encodeQRImage(text string) ([]byte, error) {
+	return goqrcode.Encode(text, goqrcode.Medium, qrImageSize)
+}
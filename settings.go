@@ -0,0 +1,202 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"maunium.net/go/mautrix/bridge/bridgeconfig"
+)
+
+var ErrSettingNotAllowed = errors.New("not allowed to change this setting")
+
+// Setting describes a Delta Chat core config key that can be read and changed through the bridge.
+type Setting struct {
+	Key         string
+	Description string
+	// Secret values are never shown and commands setting them are redacted.
+	Secret bool
+	// Validate normalizes a value entered by the user to the value stored in the core.
+	Validate func(string) (string, error)
+	// Format turns a value stored in the core into a human-readable value.
+	Format func(string) string
+}
+
+var settings = []Setting{
+	{Key: "addr", Description: "Email address"},
+	{Key: "displayname", Description: "Display name sent with messages"},
+	{Key: "selfstatus", Description: "Signature text sent with messages"},
+	{Key: "mail_server", Description: "IMAP server hostname"},
+	{Key: "mail_port", Description: "IMAP port", Validate: validatePort},
+	{Key: "mail_security", Description: "IMAP security (`automatic`, `ssl`, `starttls` or `plain`)", Validate: validateSecurity, Format: formatSecurity},
+	{Key: "mail_user", Description: "IMAP username"},
+	{Key: "mail_pw", Description: "IMAP password", Secret: true},
+	{Key: "imap_certificate_checks", Description: "IMAP certificate checks (`automatic`, `strict` or `accept-invalid`)", Validate: validateCertificateChecks, Format: formatCertificateChecks},
+	{Key: "send_server", Description: "SMTP server hostname"},
+	{Key: "send_port", Description: "SMTP port", Validate: validatePort},
+	{Key: "send_security", Description: "SMTP security (`automatic`, `ssl`, `starttls` or `plain`)", Validate: validateSecurity, Format: formatSecurity},
+	{Key: "send_user", Description: "SMTP username"},
+	{Key: "send_pw", Description: "SMTP password", Secret: true},
+	{Key: "smtp_certificate_checks", Description: "SMTP certificate checks (`automatic`, `strict` or `accept-invalid`)", Validate: validateCertificateChecks, Format: formatCertificateChecks},
+	{Key: "socks5_enabled", Description: "Connect through a SOCKS5 proxy", Validate: validateBool, Format: formatBool},
+	{Key: "socks5_host", Description: "SOCKS5 proxy hostname"},
+	{Key: "socks5_port", Description: "SOCKS5 proxy port", Validate: validatePort},
+	{Key: "socks5_user", Description: "SOCKS5 proxy username"},
+	{Key: "socks5_password", Description: "SOCKS5 proxy password", Secret: true},
+	{Key: "e2ee_enabled", Description: "Prefer end-to-end encryption", Validate: validateBool, Format: formatBool},
+	{Key: "mdns_enabled", Description: "Send read receipts", Validate: validateBool, Format: formatBool},
+	{Key: "bcc_self", Description: "Send a copy of outgoing messages to yourself, for other devices", Validate: validateBool, Format: formatBool},
+	{Key: "mvbox_move", Description: "Move chat messages to the DeltaChat folder", Validate: validateBool, Format: formatBool},
+	{Key: "only_fetch_mvbox", Description: "Only watch the DeltaChat folder", Validate: validateBool, Format: formatBool},
+	{Key: "show_emails", Description: "Which classic emails to show (`off`, `accepted` or `all`)", Validate: validateShowEmails, Format: formatShowEmails},
+	{Key: "media_quality", Description: "Quality of sent images and videos (`balanced` or `worse`)", Validate: validateMediaQuality, Format: formatMediaQuality},
+	{Key: "download_limit", Description: "Only download messages up to this many bytes automatically, 0 for no limit", Validate: validateInt},
+	{Key: "delete_device_after", Description: "Delete messages from the bridge after this many seconds, 0 to never delete", Validate: validateInt},
+	{Key: "delete_server_after", Description: "Delete messages from the server after this many seconds, 0 to never delete, 1 to delete at once", Validate: validateInt},
+}
+
+// secretKeyParts are used to mask values of keys that are not in the registry, like the configured_ copies of
+// the passwords, just in case.
+var secretKeyParts = []string{"pw", "password", "token", "key", "secret"}
+
+func getSetting(key string) (Setting, bool) {
+	for _, setting := range settings {
+		if setting.Key == key {
+			return setting, true
+		}
+	}
+	return Setting{}, false
+}
+
+func isSecretKey(key string) bool {
+	if setting, ok := getSetting(key); ok && setting.Secret {
+		return true
+	}
+	for _, part := range secretKeyParts {
+		if strings.Contains(key, part) {
+			return true
+		}
+	}
+	return false
+}
+
+// CanChange returns whether the user may change the setting. Admins may change all known settings,
+// other users only those allowlisted in the bridge config.
+func (setting Setting) CanChange(user *User) bool {
+	if user.PermissionLevel >= bridgeconfig.PermissionLevelAdmin {
+		return true
+	}
+	for _, key := range user.bridge.Config.Bridge.UserConfigKeys {
+		if key == setting.Key {
+			return true
+		}
+	}
+	return false
+}
+
+// Parse checks that the user may change the setting and returns the value entered by the user as it should
+// be stored in the core. An empty value is stored as-is, which makes the core detect the setting itself.
+func (setting Setting) Parse(user *User, value string) (string, error) {
+	if !setting.CanChange(user) {
+		return "", ErrSettingNotAllowed
+	} else if value == "" || setting.Validate == nil {
+		return value, nil
+	}
+	return setting.Validate(value)
+}
+
+// Display returns the value as it should be shown to the user.
+func (setting Setting) Display(value string) string {
+	if value == "" {
+		return "not set"
+	} else if isSecretKey(setting.Key) {
+		return "***"
+	} else if setting.Format != nil {
+		return setting.Format(value)
+	}
+	return value
+}
+
+func validatePort(value string) (string, error) {
+	port, err := strconv.Atoi(value)
+	if err != nil || port < 1 || port > 65535 {
+		return "", fmt.Errorf("%q is not a valid port", value)
+	}
+	return strconv.Itoa(port), nil
+}
+
+func validateInt(value string) (string, error) {
+	i, err := strconv.Atoi(value)
+	if err != nil || i < 0 {
+		return "", fmt.Errorf("%q is not a valid number", value)
+	}
+	return strconv.Itoa(i), nil
+}
+
+func validateBool(value string) (string, error) {
+	switch strings.ToLower(value) {
+	case "1", "true", "yes", "on":
+		return "1", nil
+	case "0", "false", "no", "off":
+		return "0", nil
+	default:
+		return "", fmt.Errorf("%q is not `on` or `off`", value)
+	}
+}
+
+func formatBool(value string) string {
+	if value == "1" {
+		return "on"
+	}
+	return "off"
+}
+
+// choiceSetting creates a validator and formatter for settings that are stored as numbers in the core.
+func choiceSetting(name string, choices map[string]string) (func(string) (string, error), func(string) string) {
+	validate := func(value string) (string, error) {
+		stored, ok := choices[strings.ToLower(value)]
+		if !ok {
+			return "", fmt.Errorf("%q is not a valid %s", value, name)
+		}
+		return stored, nil
+	}
+	format := func(value string) string {
+		for choice, stored := range choices {
+			if stored == value {
+				return choice
+			}
+		}
+		return value
+	}
+	return validate, format
+}
+
+// Values of the core's mail_security and send_security options.
+var securityModes = map[string]string{
+	"automatic": "0",
+	"ssl":       "1",
+	"starttls":  "2",
+	"plain":     "3",
+}
+
+var (
+	validateSecurity, formatSecurity = choiceSetting("security mode", securityModes)
+
+	validateCertificateChecks, formatCertificateChecks = choiceSetting("certificate check mode", map[string]string{
+		"automatic":      "0",
+		"strict":         "1",
+		"accept-invalid": "3",
+	})
+
+	validateShowEmails, formatShowEmails = choiceSetting("option", map[string]string{
+		"off":      "0",
+		"accepted": "1",
+		"all":      "2",
+	})
+
+	validateMediaQuality, formatMediaQuality = choiceSetting("quality", map[string]string{
+		"balanced": "0",
+		"worse":    "1",
+	})
+)
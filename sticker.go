@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/deltachat/deltachat-rpc-client-go/deltachat"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/event"
+
+	"go.mau.fi/mautrix-deltachat/config"
+)
+
+var stickerTargetMimeTypes = map[string]string{
+	config.StickerTargetPNG:  "image/png",
+	config.StickerTargetGIF:  "image/gif",
+	config.StickerTargetWebM: "video/webm",
+	config.StickerTargetWebP: "image/webp",
+}
+
+// handleDeltaChatSticker sends a Delta Chat sticker as an m.sticker event, converting animated stickers first.
+func (portal *Portal) handleDeltaChatSticker(intent *appservice.IntentAPI, msg *deltachat.MsgSnapshot, extra map[string]interface{}) {
+	path, mimeType := msg.File, msg.FileMime
+	width, height := msg.DimensionsWidth, msg.DimensionsHeight
+
+	converted, convertedMime, err := portal.convertAnimatedSticker(path, mimeType)
+	if err != nil {
+		portal.log.Warn().Err(err).Msg("Failed to convert animated sticker, sending as-is")
+	} else if converted != path {
+		defer os.Remove(converted)
+		path, mimeType = converted, convertedMime
+
+		// The converters keep the aspect ratio, so the configured size is only an upper bound
+		args := portal.bridge.Config.Bridge.AnimatedSticker.Args
+		width, height = args.Width, args.Height
+		if w, h, err := stickerDimensions(path, mimeType); err != nil {
+			portal.log.Warn().Err(err).Msg("Failed to get converted sticker dimensions")
+		} else {
+			width, height = w, h
+		}
+	}
+
+	file, err := portal.bridge.UploadBlobWithName(path, msg.FileName, mimeType, portal.bridge.IsRoomEncrypted(portal.MXID))
+	var tooLarge FileTooLargeError
+	if errors.As(err, &tooLarge) {
+		portal.log.Warn().Err(err).Str("file_name", msg.FileName).Msg("Sticker is too large to bridge")
+		portal.sendMessageEvent(intent, event.EventMessage, &event.Content{
+			Parsed: &event.MessageEventContent{
+				MsgType: event.MsgNotice,
+				Body:    fmt.Sprintf("Sent a sticker that couldn't be bridged (%s)", tooLarge.Error()),
+			},
+			Raw: extra,
+		})
+		return
+	} else if err != nil {
+		portal.log.Err(err).Msg("Failed to upload sticker")
+		return
+	}
+
+	content := &event.MessageEventContent{
+		Body: msg.FileName,
+		Info: &event.FileInfo{
+			MimeType: mimeType,
+			Size:     int(file.Size),
+			Width:    width,
+			Height:   height,
+		},
+	}
+	setMediaURL(content, file.MXC, file.DecryptionInfo)
+
+	_, err = portal.sendMessageEvent(intent, event.EventSticker, &event.Content{
+		Parsed: content,
+		Raw:    extra,
+	})
+	if err != nil {
+		portal.log.Err(err).Msg("Failed to send sticker")
+	}
+}
+
+// stickerDimensions reads the width and height of a converted sticker from the file.
+func stickerDimensions(path, mimeType string) (int, int, error) {
+	if mimeType == "video/webm" {
+		return videoDimensions(path)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+
+	cfg, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return cfg.Width, cfg.Height, nil
+}
+
+// videoDimensions uses ffprobe to get the width and height of the first video stream.
+func videoDimensions(path string) (int, int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mediaCommandTimeout)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, "ffprobe", "-v", "error", "-select_streams", "v:0",
+		"-show_entries", "stream=width,height", "-of", "csv=p=0:s=x", path).Output()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var width, height int
+	if _, err = fmt.Sscanf(strings.TrimSpace(string(output)), "%dx%d", &width, &height); err != nil {
+		return 0, 0, err
+	}
+
+	return width, height, nil
+}
+
+// sendMatrixSticker sends a Matrix sticker to Delta Chat with the Sticker view type.
+func (portal *Portal) sendMatrixSticker(content *event.MessageEventContent) error {
+	chat, err := portal.Chat()
+	if err != nil {
+		return err
+	}
+
+	mimeType := ""
+	if content.Info != nil {
+		mimeType = content.Info.MimeType
+	}
+
+	path, err := portal.bridge.DownloadMatrixFileToTemp(content, "mautrix-deltachat-sticker-*"+fileExtension("", mimeType))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path)
+
+	_, err = chat.SendMsg(deltachat.MsgData{ViewType: deltachat.MSG_TYPE_STICKER, File: path})
+	return err
+}
+
+// isLottieSticker returns whether the file is a Lottie animation, either plain JSON or gzipped as in Telegram's .tgs.
+func isLottieSticker(path, mimeType string) bool {
+	switch mimeType {
+	case "application/json", "application/x-tgsticker", "application/gzip", "application/x-gzip":
+	default:
+		return false
+	}
+
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".json" || ext == ".tgs" || ext == ".lottie" || mimeType == "application/x-tgsticker"
+}
+
+// convertAnimatedSticker converts Lottie and GIF stickers to the configured animated sticker target and returns
+// the path and MIME type of the result. If nothing was converted, the input path is returned. Animated WebP
+// stickers are always sent as-is, as ffmpeg can't decode them.
+func (portal *Portal) convertAnimatedSticker(path, mimeType string) (string, string, error) {
+	cfg := portal.bridge.Config.Bridge.AnimatedSticker
+	if cfg.Target == config.StickerTargetDisable {
+		return path, mimeType, nil
+	}
+
+	var err error
+	var output string
+	if isLottieSticker(path, mimeType) {
+		output, err = convertLottie(path, cfg.Target, cfg.Args.Width, cfg.Args.Height, cfg.Args.FPS)
+	} else if mimeType == "image/gif" && cfg.Target != config.StickerTargetGIF {
+		output, err = convertGIF(path, cfg.Target, cfg.Args.Width, cfg.Args.Height, cfg.Args.FPS)
+	} else {
+		return path, mimeType, nil
+	}
+
+	if err != nil {
+		return path, mimeType, err
+	}
+
+	return output, stickerTargetMimeTypes[cfg.Target], nil
+}
+
+// convertLottie renders a Lottie animation with lottieconverter. WebM and WebP are encoded with ffmpeg from
+// a GIF rendering, as lottieconverter can't produce them itself.
+func convertLottie(path, target string, width, height, fps int) (string, error) {
+	renderTarget := target
+	if target == config.StickerTargetWebM || target == config.StickerTargetWebP {
+		renderTarget = config.StickerTargetGIF
+	}
+
+	output, err := os.CreateTemp("", "mautrix-deltachat-sticker-*."+renderTarget)
+	if err != nil {
+		return "", err
+	}
+	_ = output.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), mediaCommandTimeout)
+	defer cancel()
+
+	args := []string{path, output.Name(), renderTarget, fmt.Sprintf("%dx%d", width, height)}
+	if renderTarget == config.StickerTargetGIF {
+		args = append(args, strconv.Itoa(fps))
+	}
+	if out, err := exec.CommandContext(ctx, "lottieconverter", args...).CombinedOutput(); err != nil {
+		_ = os.Remove(output.Name())
+		return "", fmt.Errorf("lottieconverter failed: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	if renderTarget == target {
+		return output.Name(), nil
+	}
+
+	defer os.Remove(output.Name())
+	return convertGIF(output.Name(), target, width, height, fps)
+}
+
+// convertGIF converts an animated GIF to a PNG of the first frame, or to WebM or WebP with ffmpeg.
+func convertGIF(path, target string, width, height, fps int) (string, error) {
+	output, err := os.CreateTemp("", "mautrix-deltachat-sticker-*."+target)
+	if err != nil {
+		return "", err
+	}
+	_ = output.Close()
+
+	if target == config.StickerTargetPNG {
+		size := width
+		if height > size {
+			size = height
+		}
+		err = writeFirstFrame(path, output.Name(), size)
+	} else {
+		err = ffmpegSticker(path, output.Name(), target, width, height, fps)
+	}
+
+	if err != nil {
+		_ = os.Remove(output.Name())
+		return "", err
+	}
+
+	return output.Name(), nil
+}
+
+func writeFirstFrame(input, output string, size int) error {
+	img, err := decodeImageFile(input)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	if err = png.Encode(&buf, scaleImage(img, size)); err != nil {
+		return err
+	}
+
+	return os.WriteFile(output, buf.Bytes(), 0600)
+}
+
+func ffmpegSticker(input, output, target string, width, height, fps int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), mediaCommandTimeout)
+	defer cancel()
+
+	filter := fmt.Sprintf("fps=%d,scale=%d:%d:force_original_aspect_ratio=decrease", fps, width, height)
+	args := []string{"-hide_banner", "-loglevel", "error", "-y", "-i", input, "-vf", filter, "-an"}
+	if target == config.StickerTargetWebM {
+		args = append(args, "-c:v", "libvpx-vp9", "-pix_fmt", "yuva420p", "-auto-alt-ref", "0")
+	} else {
+		args = append(args, "-c:v", "libwebp", "-loop", "0", "-lossless", "0", "-q:v", "80")
+	}
+	args = append(args, output)
+
+	if out, err := exec.CommandContext(ctx, "ffmpeg", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("ffmpeg failed: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
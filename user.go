@@ -1,12 +1,17 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
 
+	"github.com/creachadair/jrpc2"
 	"github.com/deltachat/deltachat-rpc-client-go/deltachat"
 	"github.com/rs/zerolog"
 
@@ -14,17 +19,30 @@ import (
 	"maunium.net/go/mautrix/appservice"
 	"maunium.net/go/mautrix/bridge"
 	"maunium.net/go/mautrix/bridge/bridgeconfig"
+	"maunium.net/go/mautrix/bridge/commands"
+	"maunium.net/go/mautrix/bridge/status"
 	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/format"
 	"maunium.net/go/mautrix/id"
 
 	"go.mau.fi/mautrix-deltachat/database"
 )
 
 var (
-	ErrNotConnected = errors.New("not connected")
-	ErrNotLoggedIn  = errors.New("not logged in")
+	ErrNotConnected    = errors.New("not connected")
+	ErrNotLoggedIn     = errors.New("not logged in")
+	ErrAlreadyLoggedIn = errors.New("already logged in")
 )
 
+// humanizeError strips the JSON-RPC framing from errors returned by the Delta Chat core.
+func humanizeError(err error) string {
+	var rpcErr *jrpc2.Error
+	if errors.As(err, &rpcErr) {
+		return rpcErr.Message
+	}
+	return err.Error()
+}
+
 type User struct {
 	*database.User
 
@@ -36,6 +54,12 @@ type User struct {
 	account       *deltachat.Account
 	accountEvents <-chan *deltachat.Event
 
+	configureStatusID id.EventID
+	imexStatusID      id.EventID
+	imexAction        string
+	loginError        string
+	commandState      *commands.CommandState
+
 	contacts map[deltachat.ContactId]*deltachat.Contact
 
 	PermissionLevel bridgeconfig.PermissionLevel
@@ -81,11 +105,11 @@ func (user *User) GetPortalID(chatID deltachat.ChatId) database.PortalID {
 }
 
 func (user *User) GetRemoteID() string {
-	if user.account == nil {
+	if user.AccountID == nil {
 		return ""
 	}
 
-	return strconv.FormatInt(int64(user.account.Id), 10)
+	return strconv.FormatUint(uint64(*user.AccountID), 10)
 }
 
 func (user *User) GetRemoteName() string {
@@ -93,7 +117,13 @@ func (user *User) GetRemoteName() string {
 		return ""
 	}
 
-	return user.account.Me().String()
+	addr, err := user.account.GetConfig("configured_addr")
+	if err != nil {
+		user.log.Warn().Err(err).Msg("Failed to get account address")
+		return ""
+	}
+
+	return addr
 }
 
 func (user *User) GetPermissionLevel() bridgeconfig.PermissionLevel {
@@ -108,8 +138,24 @@ func (user *User) GetMXID() id.UserID {
 	return user.MXID
 }
 
-func (user *User) GetCommandState() map[string]interface{} {
-	return nil
+// FileUploadHandler is stored in the command state's Meta by commands that wait for a file to be uploaded
+// to the management room.
+type FileUploadHandler func(user *User, evt *event.Event, content *event.MessageEventContent)
+
+func (user *User) GetCommandState() *commands.CommandState {
+	return user.commandState
+}
+
+// SetCommandState replaces the command state. Commands that wait for something in the background, like
+// pair-device, put a context.CancelFunc in the state's meta, which is called when the state is replaced or
+// cancelled.
+func (user *User) SetCommandState(state *commands.CommandState) {
+	if prev := user.commandState; prev != nil && prev != state {
+		if cancel, ok := prev.Meta.(context.CancelFunc); ok {
+			cancel()
+		}
+	}
+	user.commandState = state
 }
 
 func (user *User) GetIDoublePuppet() bridge.DoublePuppet {
@@ -120,7 +166,7 @@ func (user *User) GetIGhost() bridge.Ghost {
 	return nil
 }
 
-var _ bridge.User = (*User)(nil)
+var _ commands.CommandingUser = (*User)(nil)
 
 func (br *DeltaChatBridge) loadUser(dbUser *database.User, mxid *id.UserID) *User {
 	if dbUser == nil {
@@ -134,6 +180,9 @@ func (br *DeltaChatBridge) loadUser(dbUser *database.User, mxid *id.UserID) *Use
 
 	user := br.NewUser(dbUser)
 	br.usersByMXID[user.MXID] = user
+	if user.AccountID != nil {
+		br.usersByAccountID[*user.AccountID] = user
+	}
 	if user.ManagementRoom != "" {
 		br.managementRoomsLock.Lock()
 		br.managementRooms[user.ManagementRoom] = user
@@ -207,6 +256,11 @@ func (user *User) Import() error {
 		user.bridge.GetPortalByID(database.PortalID{AccountID: *user.AccountID, ChatID: chat.Id})
 	}
 
+	// fetching each puppet will implicitly update them, e.g. after the displayname template changed
+	for _, dbPuppet := range user.bridge.DB.Puppet.GetAllByAccountID(*user.AccountID) {
+		user.bridge.GetPuppetByID(dbPuppet.ID())
+	}
+
 	return nil
 }
 
@@ -253,6 +307,10 @@ func (user *User) getAccount() (*deltachat.Account, error) {
 			accountID := acc.Id
 			user.AccountID = &accountID
 			user.Update()
+
+			user.bridge.usersLock.Lock()
+			user.bridge.usersByAccountID[accountID] = user
+			user.bridge.usersLock.Unlock()
 		}
 
 		accounts, err := user.bridge.AccountManager.Accounts()
@@ -292,6 +350,32 @@ func (user *User) GetConfig(key string) (string, error) {
 	return acct.GetConfig(key)
 }
 
+// Provider status values as returned by the core's provider database.
+const (
+	ProviderStatusOK          = 1
+	ProviderStatusPreparation = 2
+	ProviderStatusBroken      = 3
+)
+
+type ProviderInfo struct {
+	BeforeLoginHint string
+	OverviewPage    string
+	Status          int
+}
+
+// GetProviderInfo looks up the email provider of the given address in the core's provider database.
+// Returns nil if the provider is unknown.
+func (user *User) GetProviderInfo(addr string) (*ProviderInfo, error) {
+	acct, err := user.getAccount()
+	if err != nil {
+		return nil, err
+	}
+
+	var info *ProviderInfo
+	err = acct.Manager.Rpc.CallResult(&info, "get_provider_info", acct.Id, addr)
+	return info, err
+}
+
 func (user *User) Login() error {
 	user.Lock()
 	defer user.Unlock()
@@ -301,18 +385,260 @@ func (user *User) Login() error {
 		return err
 	}
 
+	// make sure configure progress is reported while configuring
+	user.startAccountEvents(acct)
+
 	err = acct.Configure()
 	if err != nil {
 		return err
 	}
 
+	user.syncMatrixProfile()
+
 	return nil
 
 }
+
+// LoginWithQR configures the account from a DCACCOUNT or DCLOGIN code and connects to it.
+func (user *User) LoginWithQR(text string) error {
+	acct, err := user.Account()
+	if err != nil {
+		return err
+	}
+
+	qr, err := checkQR(acct, text)
+	if err != nil {
+		return err
+	} else if qr.Kind != QrAccount && qr.Kind != QrLogin {
+		return ErrNotLoginQR
+	}
+
+	if err = setConfigFromQR(acct, text); err != nil {
+		return err
+	}
+
+	if err = user.Login(); err != nil {
+		return err
+	}
+
+	return user.Connect()
+}
+
+// InviteQR returns the SecureJoin code to verify the user, or to join the given chat if chatID is set.
+func (user *User) InviteQR(chatID *deltachat.ChatId) (string, error) {
+	acct, err := user.Account()
+	if err != nil {
+		return "", err
+	}
+
+	var qr string
+	if chatID == nil {
+		qr, _, err = acct.QrCode()
+	} else {
+		chat := &deltachat.Chat{Account: acct, Id: *chatID}
+		qr, _, err = chat.QrCode()
+	}
+
+	return qr, err
+}
+
+// SecureJoin verifies the contact or joins the group of the given invite code. The returned portal
+// belongs to the chat with the contact or the group, which is only usable once the SecureJoin
+// handshake has finished.
+func (user *User) SecureJoin(text string) (*Portal, error) {
+	acct, err := user.Account()
+	if err != nil {
+		return nil, err
+	}
+
+	qr, err := checkQR(acct, text)
+	if err != nil {
+		return nil, err
+	} else if qr.Kind != QrAskVerifyContact && qr.Kind != QrAskVerifyGroup {
+		return nil, ErrNotInviteQR
+	}
+
+	chat, err := acct.SecureJoin(text)
+	if err != nil {
+		return nil, err
+	}
+
+	return user.bridge.GetPortalByID(user.GetPortalID(chat.Id)), nil
+}
+
+// ImportBackup imports a Delta Chat backup into the account, which must not be configured yet,
+// and then imports and connects the account like on startup.
+func (user *User) ImportBackup(path, passphrase string) error {
+	user.Lock()
+
+	acct, err := user.getAccount()
+	if err != nil {
+		user.Unlock()
+		return err
+	}
+
+	if ok, err := acct.IsConfigured(); err != nil {
+		user.Unlock()
+		return err
+	} else if ok {
+		user.Unlock()
+		return ErrAlreadyLoggedIn
+	}
+
+	user.imexAction = "Importing backup"
+	user.startAccountEvents(acct)
+
+	err = acct.ImportBackup(path, passphrase)
+	user.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return user.finishBackupSetup()
+}
+
+// finishBackupSetup syncs the Matrix profile to an account that was just set up from a backup, like Login
+// does for new accounts, and then imports and connects it like on startup.
+func (user *User) finishBackupSetup() error {
+	user.syncMatrixProfile()
+
+	if err := user.Import(); err != nil {
+		return err
+	}
+
+	return user.Connect()
+}
+
+// ExportBackup writes a backup of the account into dir and returns the path of the backup file.
+func (user *User) ExportBackup(dir, passphrase string) (string, error) {
+	user.Lock()
+	defer user.Unlock()
+
+	acct, err := user.getAccount()
+	if err != nil {
+		return "", err
+	}
+
+	user.imexAction = "Exporting backup"
+	user.startAccountEvents(acct)
+
+	if err = acct.ExportBackup(dir, passphrase); err != nil {
+		return "", err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".tar") {
+			return filepath.Join(dir, entry.Name()), nil
+		}
+	}
+
+	return "", errors.New("backup file not found after export")
+}
+
+// ProvideBackup makes the account available to a second device. It returns the DCBACKUP code
+// for the second device as soon as it's ready, and the transfer result is sent to the returned
+// channel once the second device has received the backup or the transfer failed. The transfer is
+// stopped when the context is done.
+func (user *User) ProvideBackup(ctx context.Context) (string, <-chan error, error) {
+	user.Lock()
+	defer user.Unlock()
+
+	acct, err := user.getAccount()
+	if err != nil {
+		return "", nil, err
+	}
+
+	user.imexAction = "Transferring account"
+	user.startAccountEvents(acct)
+
+	done := make(chan error, 1)
+	finished := make(chan struct{})
+	go func() {
+		err := acct.ProvideBackup()
+		close(finished)
+		done <- err
+	}()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			// provide_backup waits for the second device until the ongoing process is stopped
+			if err := acct.Manager.Rpc.Call("stop_ongoing_process", acct.Id); err != nil {
+				user.log.Err(err).Msg("Failed to stop account transfer")
+			}
+		case <-finished:
+		}
+	}()
+
+	qr, err := acct.GetBackupQr()
+	if err != nil {
+		// get_backup_qr fails if provide_backup already returned, so prefer its error
+		select {
+		case provideErr := <-done:
+			if provideErr != nil {
+				return "", nil, provideErr
+			}
+		default:
+		}
+		return "", nil, err
+	}
+
+	return qr, done, nil
+}
+
+// ReceiveBackup sets up the account, which must not be configured yet, as a second device of
+// the account offering the given DCBACKUP code, and then imports and connects it.
+func (user *User) ReceiveBackup(text string) error {
+	user.Lock()
+
+	acct, err := user.getAccount()
+	if err != nil {
+		user.Unlock()
+		return err
+	}
+
+	if ok, err := acct.IsConfigured(); err != nil {
+		user.Unlock()
+		return err
+	} else if ok {
+		user.Unlock()
+		return ErrAlreadyLoggedIn
+	}
+
+	qr, err := checkQR(acct, text)
+	if err != nil {
+		user.Unlock()
+		return err
+	} else if qr.Kind != QrBackup {
+		user.Unlock()
+		return ErrNotBackupQR
+	}
+
+	user.imexAction = "Receiving account"
+	user.startAccountEvents(acct)
+
+	err = acct.GetBackup(text)
+	user.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return user.finishBackupSetup()
+}
+
 func (user *User) IsLoggedIn() bool {
 	user.Lock()
 	defer user.Unlock()
 
+	if user.AccountID == nil {
+		return false
+	}
+
 	acct, err := user.getAccount()
 	if err != nil {
 		user.log.Err(err).Msg("Failed to get account")
@@ -328,23 +654,56 @@ func (user *User) IsLoggedIn() bool {
 	return ok
 }
 
-func (user *User) Logout(isOverwriting bool) {
+func (user *User) Logout() error {
+	if user.AccountID == nil {
+		return ErrNotLoggedIn
+	}
+
 	err := user.Disconnect()
 	if err != nil && err != ErrNotConnected {
-		user.log.Err(err).Msg("Failed to disconnect on logout")
-		return
+		return err
 	}
 
 	user.Lock()
 	defer user.Unlock()
 
-	_, err = user.getAccount()
+	acct, err := user.getAccount()
 	if err != nil {
-		user.log.Err(err).Msg("Failed to get account")
-		return
+		return err
+	}
+
+	// Portals and ghosts are only cleaned up once the account is gone, so nothing is left pointing to it
+	if err = acct.Remove(); err != nil {
+		return err
+	}
+
+	cleanup := user.bridge.Config.Bridge.CleanupOnLogout
+	for _, portal := range user.bridge.GetAllPortalsByAccountID(acct.Id) {
+		if cleanup {
+			portal.Cleanup()
+		}
+		portal.Delete()
 	}
 
-	// FIXME: delete account data?
+	for _, dbPuppet := range user.bridge.DB.Puppet.GetAllByAccountID(acct.Id) {
+		user.bridge.NewPuppet(dbPuppet).Delete()
+	}
+
+	user.BridgeState.Send(status.BridgeState{StateEvent: status.StateLoggedOut})
+
+	user.bridge.usersLock.Lock()
+	delete(user.bridge.usersByAccountID, acct.Id)
+	user.bridge.usersLock.Unlock()
+
+	user.account = nil
+	user.accountEvents = nil
+	user.AccountID = nil
+	user.LastLocationID = 0
+	user.SyncedAvatarURL = id.ContentURI{}
+	user.contacts = map[deltachat.ContactId]*deltachat.Contact{}
+	user.Update()
+
+	return nil
 }
 
 func (user *User) Connected() bool {
@@ -364,6 +723,56 @@ func (user *User) Connected() bool {
 	return conn >= DC_CONNECTIVITY_CONNECTING
 }
 
+var (
+	connectivityBodyRegex = regexp.MustCompile(`(?is)<body[^>]*>(.*)</body>`)
+	connectivityDotRegex  = regexp.MustCompile(`(?is)<(?:span|div)[^>]*class="dot (green|yellow|red)"[^>]*>\s*</(?:span|div)>`)
+)
+
+// The status dots of the connectivity report are only colored by its stylesheet
+var connectivityDots = map[string]string{
+	"green":  "🟢",
+	"yellow": "🟡",
+	"red":    "🔴",
+}
+
+// ConnectivityReport returns the core's connectivity HTML report converted to markdown. It lists the state of
+// the IMAP folders and SMTP as well as the storage quota.
+func (user *User) ConnectivityReport() (string, error) {
+	acct, err := user.Account()
+	if err != nil {
+		return "", err
+	}
+
+	var report string
+	err = acct.Manager.Rpc.CallResult(&report, "get_connectivity_html", acct.Id)
+	if err != nil {
+		return "", err
+	}
+
+	// The report is a full document with a stylesheet that Matrix clients can't use
+	if match := connectivityBodyRegex.FindStringSubmatch(report); match != nil {
+		report = match[1]
+	}
+	report = connectivityDotRegex.ReplaceAllStringFunc(report, func(dot string) string {
+		return connectivityDots[strings.ToLower(connectivityDotRegex.FindStringSubmatch(dot)[1])]
+	})
+
+	return strings.TrimSpace(format.HTMLToMarkdown(report)), nil
+}
+
+func connectivityName(conn uint) string {
+	switch {
+	case conn >= DC_CONNECTIVITY_CONNECTED:
+		return "connected"
+	case conn >= DC_CONNECTIVITY_WORKING:
+		return "updating"
+	case conn >= DC_CONNECTIVITY_CONNECTING:
+		return "connecting"
+	default:
+		return "not connected"
+	}
+}
+
 func (user *User) Connect() error {
 	user.Lock()
 	defer user.Unlock()
@@ -379,19 +788,60 @@ func (user *User) Connect() error {
 		return ErrNotLoggedIn
 	}
 
+	user.BridgeState.Send(status.BridgeState{StateEvent: status.StateConnecting})
+
 	if err = acct.StartIO(); err != nil {
 		return err
 	}
 
-	go user.processAccountEvents(user.account.GetEventChannel())
+	user.startAccountEvents(acct)
 	return nil
 }
 
+func (user *User) startAccountEvents(acct *deltachat.Account) {
+	if user.accountEvents != nil {
+		return
+	}
+
+	user.accountEvents = acct.GetEventChannel()
+	go user.processAccountEvents(user.accountEvents)
+}
+
 const DC_CONNECTIVITY_NOT_CONNECTED = 1000
 const DC_CONNECTIVITY_CONNECTING = 2000
 const DC_CONNECTIVITY_WORKING = 3000
 const DC_CONNECTIVITY_CONNECTED = 4000
 
+// cannotLoginPrefix is how the core's error starts when the email server rejects the credentials.
+const cannotLoginPrefix = "Cannot login as"
+
+const (
+	DCLoginFailed  status.BridgeStateErrorCode = "dc-login-failed"
+	DCNotConnected status.BridgeStateErrorCode = "dc-not-connected"
+)
+
+func init() {
+	status.BridgeStateHumanErrors.Update(status.BridgeStateErrorMap{
+		DCNotConnected: "Not connected to the email server",
+	})
+}
+
+// connectivityBridgeState maps the core's connectivity to a bridge state. Credential errors are only reported
+// through error events, so the last one is remembered until the account connects successfully again.
+func (user *User) connectivityBridgeState(conn uint) status.BridgeState {
+	switch {
+	case conn >= DC_CONNECTIVITY_WORKING:
+		user.loginError = ""
+		return status.BridgeState{StateEvent: status.StateConnected}
+	case conn >= DC_CONNECTIVITY_CONNECTING:
+		return status.BridgeState{StateEvent: status.StateConnecting}
+	case user.loginError != "":
+		return status.BridgeState{StateEvent: status.StateBadCredentials, Error: DCLoginFailed, Message: user.loginError}
+	default:
+		return status.BridgeState{StateEvent: status.StateTransientDisconnect, Error: DCNotConnected}
+	}
+}
+
 func (user *User) processAccountEvents(eventsChan <-chan *deltachat.Event) {
 	log := user.log.With().Str("component", "account_events").Logger()
 	acct, err := user.getAccount()
@@ -413,37 +863,51 @@ func (user *User) processAccountEvents(eventsChan <-chan *deltachat.Event) {
 		case deltachat.EVENT_ERROR:
 			log.Error().Msg(evt.Msg)
 			message = fmt.Sprintf("%s: %s", evt.Type, evt.Msg)
+			if strings.HasPrefix(evt.Msg, cannotLoginPrefix) {
+				user.loginError = evt.Msg
+			}
 		case deltachat.EVENT_WARNING:
 			log.Warn().Msg(evt.Msg)
 			message = fmt.Sprintf("%s: %s", evt.Type, evt.Msg)
 		case deltachat.EVENT_CONFIGURE_PROGRESS:
-			message = fmt.Sprintf("%s: %d", evt.Type, evt.Progress)
+			user.configureStatusID = user.updateProgressNotice(user.configureStatusID, "Configuring account", evt.Progress)
+		case deltachat.EVENT_IMEX_PROGRESS:
+			user.imexStatusID = user.updateProgressNotice(user.imexStatusID, user.imexAction, evt.Progress)
+		case deltachat.EVENT_SECUREJOIN_INVITER_PROGRESS:
+			user.handleSecureJoinProgress(acct, evt.ContactId, evt.Progress, true)
+		case deltachat.EVENT_SECUREJOIN_JOINER_PROGRESS:
+			user.handleSecureJoinProgress(acct, evt.ContactId, evt.Progress, false)
+		case deltachat.EVENT_IMEX_FILE_WRITTEN:
+			log.Debug().Str("path", evt.Path).Msg("Export file written")
 		case deltachat.EVENT_CONNECTIVITY_CHANGED:
-			conn, err := user.account.Connectivity()
+			conn, err := acct.Connectivity()
 			if err != nil {
 				log.Err(err).Msg("Connectivity check failed")
 			}
 
-			status := "Disconnected."
-			if conn >= DC_CONNECTIVITY_CONNECTED {
-				status = "Connected!"
-			} else if conn >= DC_CONNECTIVITY_WORKING {
-				status = "Working..."
-			} else if conn >= DC_CONNECTIVITY_CONNECTING {
-				status = "Connecting..."
-			} else if conn >= DC_CONNECTIVITY_NOT_CONNECTED {
-				status = "Not connected..."
-			}
-			message = status
+			user.BridgeState.Send(user.connectivityBridgeState(conn))
 		case deltachat.EVENT_INCOMING_MSG:
-			msg := deltachat.Message{Account: user.account, Id: evt.MsgId}
+			msg := deltachat.Message{Account: acct, Id: evt.MsgId}
 			snap, err := msg.Snapshot()
 			if err != nil {
 				user.log.Err(err).Msg("Failed to get incoming message snapshot")
 				break
 			}
 
+			if snap.IsSetupmessage {
+				// Setup messages contain an encrypted secret key and are only useful via commands
+				user.sendNotice("Received an Autocrypt Setup Message (setup code starting with `%s`). "+
+					"Send `accept-autocrypt-setup %d <setup code>` to import the key.", snap.SetupCodeBegin, snap.Id)
+				break
+			}
+
 			portal := user.bridge.GetPortalByID(database.PortalID{AccountID: acct.Id, ChatID: snap.ChatId})
+			if portal.Type == deltachat.CHAT_TYPE_BROADCAST && snap.FromId != deltachat.CONTACT_SELF {
+				// Recipients see broadcasts as private messages, so their replies belong in the DM
+				if dm := user.getOrCreatePrivateChatPortal(acct, snap.FromId); dm != nil {
+					portal = dm
+				}
+			}
 			portal.ReceiveDeltaChatMessage(snap)
 		case deltachat.EVENT_INCOMING_MSG_BUNCH:
 			// not used
@@ -454,6 +918,15 @@ func (user *User) processAccountEvents(eventsChan <-chan *deltachat.Event) {
 				user.log.Err(err).Msg("Failed to update puppet")
 				break
 			}
+
+			// DM portals may use the contact's name and avatar
+			if portal := user.getPrivateChatPortal(acct, evt.ContactId); portal != nil && portal.MXID != "" {
+				if err = portal.Update(); err != nil {
+					user.log.Err(err).Msg("Failed to update private chat portal")
+				}
+			}
+		case deltachat.EVENT_LOCATION_CHANGED:
+			user.handleLocationChanged(acct)
 		case deltachat.EVENT_CHAT_MODIFIED:
 			portal := user.bridge.GetPortalByID(database.PortalID{AccountID: acct.Id, ChatID: evt.ChatId})
 			portal.Update()
@@ -468,16 +941,154 @@ func (user *User) processAccountEvents(eventsChan <-chan *deltachat.Event) {
 		}
 
 		if message != "" {
-			user.bridge.AS.BotIntent().SendMessageEvent(user.GetManagementRoomID(), event.EventMessage, event.MessageEventContent{
-				MsgType: event.MsgNotice,
-				Body:    message,
+			_, err = user.bridge.SendMessageEvent(user.bridge.Bot, user.GetManagementRoomID(), event.EventMessage, &event.Content{
+				Parsed: &event.MessageEventContent{
+					MsgType: event.MsgNotice,
+					Body:    message,
+				},
 			})
+			if err != nil {
+				user.log.Err(err).Msg("Failed to send notice to management room")
+			}
 		}
 	}
 
 	user.log.Debug().Msg("Account event loop exit.")
 }
 
+// updateProgressNotice keeps a single status message in the management room up to date for progress events
+// and returns the event ID to edit on the next update.
+func (user *User) updateProgressNotice(eventID id.EventID, action string, progress uint) id.EventID {
+	var message string
+	switch progress {
+	case 0:
+		message = fmt.Sprintf("%s failed.", action)
+	case 1000:
+		message = fmt.Sprintf("%s completed.", action)
+	default:
+		message = fmt.Sprintf("%s... %d%%", action, progress/10)
+	}
+
+	if eventID == "" {
+		eventID = user.sendNotice(message)
+	} else {
+		user.editNotice(eventID, message)
+	}
+
+	if progress == 0 || progress == 1000 {
+		return ""
+	}
+
+	return eventID
+}
+
+func (user *User) sendNotice(message string, args ...interface{}) id.EventID {
+	if len(args) > 0 {
+		message = fmt.Sprintf(message, args...)
+	}
+
+	content := format.RenderMarkdown(message, true, false)
+	content.MsgType = event.MsgNotice
+
+	resp, err := user.bridge.SendMessageEvent(user.bridge.Bot, user.GetManagementRoomID(), event.EventMessage, &event.Content{Parsed: &content})
+	if err != nil {
+		user.log.Err(err).Msg("Failed to send notice to management room")
+		return ""
+	}
+
+	return resp.EventID
+}
+
+func (user *User) editNotice(eventID id.EventID, message string, args ...interface{}) {
+	if len(args) > 0 {
+		message = fmt.Sprintf(message, args...)
+	}
+
+	content := format.RenderMarkdown(message, true, false)
+	content.MsgType = event.MsgNotice
+	content.SetEdit(eventID)
+
+	_, err := user.bridge.SendMessageEvent(user.bridge.Bot, user.GetManagementRoomID(), event.EventMessage, &event.Content{Parsed: &content})
+	if err != nil {
+		user.log.Err(err).Msg("Failed to edit notice in management room")
+	}
+}
+
+// handleManagementRoomFile passes files and images uploaded to the management room to the command state
+// waiting for an upload. Files uploaded without such a command are ignored.
+func (user *User) handleManagementRoomFile(evt *event.Event, content *event.MessageEventContent) {
+	state := user.GetCommandState()
+	if state == nil {
+		return
+	}
+
+	if handler, ok := state.Meta.(FileUploadHandler); ok {
+		user.SetCommandState(nil)
+		handler(user, evt, content)
+	}
+}
+
+// getPrivateChatPortal returns the portal of the DM with the contact, or nil if there is no DM or it has no portal.
+func (user *User) getPrivateChatPortal(acct *deltachat.Account, contactID deltachat.ContactId) *Portal {
+	var chatID *deltachat.ChatId
+	err := acct.Manager.Rpc.CallResult(&chatID, "get_chat_id_by_contact_id", acct.Id, contactID)
+	if err != nil {
+		user.log.Err(err).Msg("Failed to get private chat of contact")
+		return nil
+	} else if chatID == nil {
+		return nil
+	}
+
+	return user.bridge.GetExistingPortalByID(database.PortalID{AccountID: acct.Id, ChatID: *chatID})
+}
+
+// getOrCreatePrivateChatPortal returns the portal of the DM with the contact, creating the chat if needed.
+func (user *User) getOrCreatePrivateChatPortal(acct *deltachat.Account, contactID deltachat.ContactId) *Portal {
+	contact := &deltachat.Contact{Account: acct, Id: contactID}
+	chat, err := contact.CreateChat()
+	if err != nil {
+		user.log.Err(err).Msg("Failed to create private chat with contact")
+		return nil
+	}
+
+	return user.bridge.GetPortalByID(database.PortalID{AccountID: acct.Id, ChatID: chat.Id})
+}
+
+// SecureJoin progress steps as reported by the core.
+const (
+	secureJoinFailed            = 0
+	secureJoinInviterRequested  = 300
+	secureJoinInviterVerified   = 600
+	secureJoinInviterAddedGroup = 800
+	secureJoinJoinerAuthRequest = 400
+	secureJoinCompleted         = 1000
+)
+
+func (user *User) handleSecureJoinProgress(acct *deltachat.Account, contactID deltachat.ContactId, progress uint, inviter bool) {
+	name := fmt.Sprintf("contact %d", contactID)
+	contact := &deltachat.Contact{Account: acct, Id: contactID}
+	if snap, err := contact.Snapshot(); err != nil {
+		user.log.Err(err).Msg("Failed to get SecureJoin contact snapshot")
+	} else {
+		name = fmt.Sprintf("%s (%s)", snap.DisplayName, snap.Address)
+	}
+
+	switch {
+	case progress == secureJoinFailed:
+		user.sendNotice("Verification with %s failed.", name)
+	case inviter && progress == secureJoinInviterRequested:
+		user.sendNotice("%s scanned your invite code, verifying...", name)
+	case inviter && progress == secureJoinInviterVerified:
+		user.sendNotice("%s is now verified.", name)
+	case inviter && progress == secureJoinInviterAddedGroup:
+		user.sendNotice("%s was added to the group.", name)
+	case !inviter && progress == secureJoinJoinerAuthRequest:
+		user.sendNotice("%s accepted the invite code, verifying...", name)
+	case !inviter && progress == secureJoinCompleted:
+		user.sendNotice("%s is now verified.", name)
+	}
+}
+
 func (user *User) Disconnect() error {
 	user.Lock()
 	defer user.Unlock()